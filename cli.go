@@ -0,0 +1,392 @@
+// © 2022 Sloan Childers
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/osintami/monster/server"
+	"github.com/osintami/monster/utils"
+)
+
+const (
+	FORMAT_JSON  = "json"
+	FORMAT_TABLE = "table"
+)
+
+var ErrNotDgraph = errors.New("schema commands need IDENTITY_STORE=dgraph")
+var ErrConfirm = errors.New("schema drop removes every node, pass -confirm")
+
+// Writes a result as indented JSON, or as a table of rows under a header.
+type printer struct {
+	format string
+	out    io.Writer
+}
+
+func (x printer) print(v interface{}, header []string, rows [][]string) error {
+	if x.format == FORMAT_JSON {
+		out := json.NewEncoder(x.out)
+		out.SetIndent("", "  ")
+		return out.Encode(v)
+	}
+	w := tabwriter.NewWriter(x.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// Parse a subcommand's flags, -format is common to all of them.  Flags go before the arguments.
+func parseFlags(name string, args []string, define func(flags *flag.FlagSet)) (printer, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	format := flags.String("format", FORMAT_TABLE, "json or table")
+	if define != nil {
+		define(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return printer{}, nil, err
+	}
+	if *format != FORMAT_JSON && *format != FORMAT_TABLE {
+		return printer{}, nil, ErrUsage
+	}
+	return printer{format: *format, out: os.Stdout}, flags.Args(), nil
+}
+
+func runSchema(cfg utils.ServerConfig, command string, args []string) error {
+	if cfg.IdentityStore != utils.STORE_DGRAPH {
+		return ErrNotDgraph
+	}
+	var confirm bool
+	out, _, err := parseFlags("schema "+command, args, func(flags *flag.FlagSet) {
+		flags.BoolVar(&confirm, "confirm", false, "really drop the schema and data")
+	})
+	if err != nil {
+		return err
+	}
+	graph, err := utils.NewDgraph(cfg)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+	ctx := context.Background()
+
+	switch command {
+	case "apply":
+		applied, err := graph.Migrate(ctx, utils.Migrations)
+		versions := []map[string]interface{}{}
+		rows := [][]string{}
+		for _, m := range applied {
+			versions = append(versions, map[string]interface{}{"version": m.Version, "name": m.Name})
+			rows = append(rows, []string{strconv.Itoa(m.Version), m.Name})
+		}
+		if perr := out.print(versions, []string{"VERSION", "APPLIED"}, rows); perr != nil {
+			return perr
+		}
+		return err
+	case "drop":
+		if !confirm {
+			return ErrConfirm
+		}
+		return graph.DropSchema(ctx)
+	case "show":
+		live, err := graph.LiveSchema(ctx)
+		if err != nil {
+			return err
+		}
+		rows := [][]string{}
+		for _, p := range live.Predicates {
+			rows = append(rows, []string{p.Predicate, p.String()})
+		}
+		return out.print(live, []string{"PREDICATE", "TYPE"}, rows)
+	}
+	return ErrUsage
+}
+
+func runCookie(cfg utils.ServerConfig, command string, args []string) error {
+	var tags string
+	out, args, err := parseFlags("cookie "+command, args, func(flags *flag.FlagSet) {
+		flags.StringVar(&tags, "tags", "", "comma separated tags for a new cookie")
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	ctx := context.Background()
+
+	switch command {
+	case "get":
+		cookie, err := store.FindCookie(ctx, args[0])
+		if err != nil && err != utils.ErrDuplicateCookiesExist {
+			return err
+		}
+		return printCookie(out, cookie)
+	case "create":
+		cookie := utils.Cookie{CookieID: args[0]}
+		if tags != "" {
+			cookie.Tags = strings.Split(tags, ",")
+		}
+		created, err := store.CreateCookie(ctx, cookie)
+		if err != nil {
+			return err
+		}
+		return printCookie(out, created)
+	case "cluster":
+		ids, err := store.FindCluster(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		rows := [][]string{}
+		for _, id := range ids {
+			rows = append(rows, []string{id})
+		}
+		return out.print(ids, []string{"COOKIE"}, rows)
+	case "delete":
+		// the same erasure as DELETE /admin/identity, a running server would write its own copy
+		// of cache.db back over this one
+		cache := utils.NewFileCache(cfg.FSPath+"cache.db", false)
+		if err := cache.LoadFile(); err != nil {
+			return err
+		}
+		receipt, err := server.EraseSubject(ctx, cache, store, server.SUBJECT_MUID, args[0])
+		if err != nil {
+			return err
+		}
+		rows := [][]string{}
+		for _, node := range receipt.Nodes {
+			rows = append(rows, []string{node.Type, node.Uid})
+		}
+		for _, key := range receipt.CacheEntries {
+			rows = append(rows, []string{"Cache", key})
+		}
+		return out.print(receipt, []string{"TYPE", "UID"}, rows)
+	}
+	return ErrUsage
+}
+
+func runBrowser(cfg utils.ServerConfig, command string, args []string) error {
+	var ua, ip string
+	out, _, err := parseFlags("browser "+command, args, func(flags *flag.FlagSet) {
+		flags.StringVar(&ua, "ua", "", "user agent")
+		flags.StringVar(&ip, "ip", "", "client address")
+	})
+	if err != nil {
+		return err
+	}
+	if command != "find" || ua == "" || ip == "" {
+		return ErrUsage
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	browser, err := store.FindBrowser(context.Background(), ua, ip)
+	if err != nil {
+		return err
+	}
+	return out.print(browser, []string{"UID", "ADDR", "BROWSER", "OS", "ANONYMIZER", "ENRICHMENTS"},
+		[][]string{browserRow(*browser)})
+}
+
+// The partners linked to one of our cookies, or with -pcid our cookies linked to a partner's.
+func runPartner(cfg utils.ServerConfig, command string, args []string) error {
+	var pcid string
+	out, args, err := parseFlags("partner "+command, args, func(flags *flag.FlagSet) {
+		flags.StringVar(&pcid, "pcid", "", "a partner's cookie id")
+	})
+	if err != nil {
+		return err
+	}
+	if command != "list" || (pcid == "") == (len(args) == 0) {
+		return ErrUsage
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	ctx := context.Background()
+
+	if pcid != "" {
+		ids, err := store.FindCookieIDsByPartner(ctx, pcid)
+		if err != nil {
+			return err
+		}
+		rows := [][]string{}
+		for _, id := range ids {
+			rows = append(rows, []string{id})
+		}
+		return out.print(ids, []string{"COOKIE"}, rows)
+	}
+	cookie, err := store.FindCookie(ctx, args[0])
+	if err != nil && err != utils.ErrDuplicateCookiesExist {
+		return err
+	}
+	rows := [][]string{}
+	for _, p := range cookie.Partners {
+		rows = append(rows, []string{p.Uid, p.PartnerID, p.CookieID, strconv.Itoa(p.Hits), stamp(p.FirstSeen), stamp(p.LastSeen)})
+	}
+	return out.print(cookie.Partners, []string{"UID", "PARTNER", "PCOOKIE", "HITS", "FIRST SEEN", "LAST SEEN"}, rows)
+}
+
+func runMerge(cfg utils.ServerConfig, args []string) error {
+	out, args, err := parseFlags("merge", args, nil)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return ErrUsage
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	merged, err := store.MergeCookies(context.Background(), args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return printCookie(out, merged)
+}
+
+// Every cookie as one JSON line, to -file or stdout.
+func runExportCookies(cfg utils.ServerConfig, args []string) error {
+	var file string
+	_, _, err := parseFlags("export", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&file, "file", "", "write here instead of stdout")
+	})
+	if err != nil {
+		return err
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	w := io.Writer(os.Stdout)
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buf := bufio.NewWriter(w)
+	out := json.NewEncoder(buf)
+
+	ctx := context.Background()
+	count := 0
+	after := ""
+	for {
+		page, err := store.ScanCookies(ctx, after, utils.EXPORT_BATCH)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, cookie := range page {
+			if err := out.Encode(cookie); err != nil {
+				return err
+			}
+		}
+		count += len(page)
+		after = page[len(page)-1].Uid
+	}
+	log.Info().Str("component", "monster").Int("cookies", count).Msg("export")
+	return buf.Flush()
+}
+
+// Restore the JSON lines export writes, from -file or stdin.  Cookies already held are skipped.
+func runImportCookies(cfg utils.ServerConfig, args []string) error {
+	var file string
+	out, _, err := parseFlags("import", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&file, "file", "", "read here instead of stdin")
+	})
+	if err != nil {
+		return err
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	r := io.Reader(os.Stdin)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx := context.Background()
+	report := struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}{}
+	in := json.NewDecoder(bufio.NewReader(r))
+	for in.More() {
+		var cookie utils.Cookie
+		if err := in.Decode(&cookie); err != nil {
+			return err
+		}
+		_, err := store.RestoreCookie(ctx, cookie)
+		if err == utils.ErrCookieExists {
+			report.Skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		report.Imported++
+	}
+	return out.print(report, []string{"IMPORTED", "SKIPPED"},
+		[][]string{{strconv.Itoa(report.Imported), strconv.Itoa(report.Skipped)}})
+}
+
+// One row for the cookie, then one per edge.
+func printCookie(out printer, cookie *utils.Cookie) error {
+	rows := [][]string{{"cookie", cookie.Uid, cookie.CookieID + " " + strings.Join(cookie.Tags, ","), "", stamp(cookie.IssuedAt), stamp(cookie.SeenAt), ""}}
+	for _, b := range cookie.Browsers {
+		rows = append(rows, []string{"browser", b.Uid, b.Addr + " " + b.UserAgent, strconv.Itoa(b.Hits), stamp(b.FirstSeen), stamp(b.LastSeen), b.Source})
+	}
+	for _, p := range cookie.Partners {
+		rows = append(rows, []string{"partner", p.Uid, p.PartnerID + " " + p.CookieID, strconv.Itoa(p.Hits), stamp(p.FirstSeen), stamp(p.LastSeen), p.Source})
+	}
+	return out.print(cookie, []string{"EDGE", "UID", "NODE", "HITS", "FIRST SEEN", "LAST SEEN", "SOURCE"}, rows)
+}
+
+func browserRow(b utils.Browser) []string {
+	return []string{b.Uid, b.Addr, strings.TrimSpace(b.BrowserFamily + " " + strconv.Itoa(b.BrowserMajor)),
+		b.OSFamily, b.Anonymizer, strconv.Itoa(len(b.Enrichments))}
+}
+
+func stamp(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
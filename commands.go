@@ -0,0 +1,191 @@
+// © 2022 Sloan Childers
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/osintami/monster/server"
+	"github.com/osintami/monster/utils"
+)
+
+var ErrUsage = errors.New(`usage:
+  monster migrate up|status
+  monster schema apply|show|drop [-confirm]
+  monster cookie get|create|delete|cluster [-tags a,b] <muid>
+  monster browser find -ua <user agent> -ip <address>
+  monster partner list <muid> | -pcid <partner cookie>
+  monster merge <into muid> <from muid>
+  monster export [-file <path>]
+  monster import [-file <path>]
+  monster dsar export -muid|-pcid|-hem <value>
+  monster retention sweep [-window <duration>] [-dry-run]
+every command but export takes -format json|table, flags go before arguments
+cookie delete also removes the muid from cache.db, run it with the server stopped`)
+var ErrStore = errors.New("unknown identity store, IDENTITY_STORE is dgraph or sql")
+
+// Admin commands run instead of the server when monster is given arguments.
+func RunCommand(cfg utils.ServerConfig, args []string) error {
+	switch args[0] {
+	case "merge":
+		return runMerge(cfg, args[1:])
+	case "export":
+		return runExportCookies(cfg, args[1:])
+	case "import":
+		return runImportCookies(cfg, args[1:])
+	}
+	if len(args) < 2 {
+		return ErrUsage
+	}
+	switch args[0] {
+	case "migrate":
+		return runMigrate(cfg, args[1])
+	case "schema":
+		return runSchema(cfg, args[1], args[2:])
+	case "cookie":
+		return runCookie(cfg, args[1], args[2:])
+	case "browser":
+		return runBrowser(cfg, args[1], args[2:])
+	case "partner":
+		return runPartner(cfg, args[1], args[2:])
+	case "dsar":
+		if args[1] != "export" {
+			return ErrUsage
+		}
+		return runExport(cfg, args[2:])
+	case "retention":
+		if args[1] != "sweep" {
+			return ErrUsage
+		}
+		return runSweep(cfg, args[2:])
+	}
+	return ErrUsage
+}
+
+// The configured identity store, the graph is nil unless the backend is dgraph.
+func openStore(cfg utils.ServerConfig) (utils.IdentityStore, *utils.Dgraph, error) {
+	switch cfg.IdentityStore {
+	case utils.STORE_DGRAPH:
+		graph, err := utils.NewDgraph(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return utils.NewDgraphStore(graph), graph, nil
+	case utils.STORE_SQL:
+		store, err := utils.NewSQLStore(cfg.SQLDriver, cfg.SQLDSN, cfg.UAVersionTolerance)
+		return store, nil, err
+	}
+	return nil, nil, ErrStore
+}
+
+func closeStore(store utils.IdentityStore) {
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// The reconcile audit log under FSPath, empty when it is turned off.
+func auditPath(cfg utils.ServerConfig) string {
+	if cfg.ReconcileAuditFile == "" {
+		return ""
+	}
+	return cfg.FSPath + cfg.ReconcileAuditFile
+}
+
+func runMigrate(cfg utils.ServerConfig, command string) error {
+	graph, err := utils.NewDgraph(cfg)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+	ctx := context.Background()
+
+	switch command {
+	case "up":
+		applied, err := graph.Migrate(ctx, utils.Migrations)
+		for _, m := range applied {
+			fmt.Fprintf(os.Stdout, "applied %d %s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(os.Stdout, "schema up to date")
+		}
+		return err
+	case "status":
+		status, err := graph.MigrationStatus(ctx, utils.Migrations)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "current %d\nlatest  %d\n", status.Current, status.Latest)
+		for _, m := range status.Pending {
+			fmt.Fprintf(os.Stdout, "pending %d %s\n", m.Version, m.Name)
+		}
+		return nil
+	}
+	return ErrUsage
+}
+
+// Write the access export for one person to stdout, reading the cache files without touching them.
+func runExport(cfg utils.ServerConfig, args []string) error {
+	flags := flag.NewFlagSet("dsar export", flag.ContinueOnError)
+	muid := flags.String(server.SUBJECT_MUID, "", "our cookie id")
+	pcid := flags.String(server.SUBJECT_PARTNER, "", "a partner's cookie id")
+	hem := flags.String(server.SUBJECT_HEM, "", "hashed email")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	by, value := server.SUBJECT_MUID, *muid
+	if *pcid != "" {
+		by, value = server.SUBJECT_PARTNER, *pcid
+	} else if *hem != "" {
+		by, value = server.SUBJECT_HEM, *hem
+	}
+
+	cache := utils.NewFileCache(cfg.FSPath+"cache.db", false).ReadOnly()
+	if err := cache.LoadFile(); err != nil {
+		return err
+	}
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	export, err := server.ExportSubject(context.Background(), cache, store, by, value)
+	if err != nil {
+		return err
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(export)
+}
+
+// One retention pass now, the counts go to stdout.
+func runSweep(cfg utils.ServerConfig, args []string) error {
+	flags := flag.NewFlagSet("retention sweep", flag.ContinueOnError)
+	window := flags.Duration("window", cfg.RetentionWindow, "sweep cookies not seen for this long")
+	dryRun := flags.Bool("dry-run", cfg.RetentionDryRun, "count without deleting")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *window <= 0 {
+		return ErrUsage
+	}
+	if !cfg.GraphSync {
+		return utils.ErrRetentionSync
+	}
+	graph, err := utils.NewDgraph(cfg)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+	sweeper := utils.NewRetentionSweeper(graph, *window, cfg.RetentionBatch, *dryRun)
+	report, err := sweeper.Sweep(context.Background())
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(report)
+	return err
+}
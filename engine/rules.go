@@ -0,0 +1,294 @@
+// © 2022 Sloan Childers
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sync decisions
+const (
+	SYNC_ALLOW = "allow"
+	SYNC_DENY  = "deny"
+)
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+// What is known about a sync request when the rules run.
+type Facts struct {
+	PartnerID     string
+	Country       string
+	Region        string
+	ASN           uint
+	GDPRApplies   bool
+	Consent       bool // consent string present, or GDPR does not apply
+	Traffic       string
+	Anonymizer    string
+	DeviceType    string
+	BrowserFamily string
+	OSFamily      string
+	NewCookie     bool
+	CookieAge     time.Duration
+}
+
+// Accepts Go duration strings in JSON, e.g. "720h".
+type Duration struct {
+	time.Duration
+}
+
+func (x *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	x.Duration = d
+	return nil
+}
+
+// Every condition that is set must hold, list conditions hold when any value matches.
+type Match struct {
+	Partners        []string  `json:"partners,omitempty"`
+	Countries       []string  `json:"countries,omitempty"`
+	Regions         []string  `json:"regions,omitempty"`
+	ASNs            []uint    `json:"asns,omitempty"`
+	GDPR            *bool     `json:"gdpr,omitempty"`
+	Consent         *bool     `json:"consent,omitempty"`
+	Traffic         []string  `json:"traffic,omitempty"`
+	Anonymizers     []string  `json:"anonymizers,omitempty"`
+	DeviceTypes     []string  `json:"device_types,omitempty"`
+	BrowserFamilies []string  `json:"browser_families,omitempty"`
+	OSFamilies      []string  `json:"os_families,omitempty"`
+	NewCookie       *bool     `json:"new_cookie,omitempty"`
+	MinCookieAge    *Duration `json:"min_cookie_age,omitempty"`
+	MaxCookieAge    *Duration `json:"max_cookie_age,omitempty"`
+}
+
+type Action struct {
+	Sync           string   `json:"sync,omitempty"`
+	Redirect       string   `json:"redirect,omitempty"`
+	SuppressMacros []string `json:"suppress_macros,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+type Rule struct {
+	Name   string `json:"name"`
+	Match  Match  `json:"match"`
+	Action Action `json:"action"`
+	Stop   bool   `json:"stop,omitempty"`
+}
+
+type RuleSet struct {
+	Rules []Rule `json:"rules"`
+}
+
+// The combined outcome, the first matching rule to set sync or redirect wins, macros and tags add up.
+type Decision struct {
+	Sync           string
+	Redirect       string
+	SuppressMacros []string
+	Tags           []string
+	Matched        []string
+}
+
+func (x Decision) Denied() bool {
+	return x.Sync == SYNC_DENY
+}
+
+// Sync policy from a JSON rules file, re-read when the file changes so ops can change it without a deploy.
+type RulesEngine struct {
+	path    string
+	mu      sync.RWMutex
+	rules    []Rule
+	modTime  time.Time
+	loadedAt time.Time
+	stop     chan struct{}
+	once    sync.Once
+}
+
+// A missing file means no rules, every sync is allowed.
+func NewRulesEngine(path string) *RulesEngine {
+	x := &RulesEngine{path: path, stop: make(chan struct{})}
+	if err := x.Reload(); err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("component", "rules").Str("path", path).Msg("load")
+	}
+	return x
+}
+
+// Re-read the file if it changed.  A file that cannot be read or is invalid leaves the current
+// rules in place, one that was removed takes them away as it would at startup.
+func (x *RulesEngine) Reload() error {
+	info, err := os.Stat(x.path)
+	if os.IsNotExist(err) {
+		x.mu.Lock()
+		removed := !x.modTime.IsZero()
+		x.rules, x.modTime, x.loadedAt = nil, time.Time{}, time.Time{}
+		x.mu.Unlock()
+		if removed {
+			log.Warn().Str("component", "rules").Str("path", x.path).Msg("rules file removed, every sync is allowed")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	x.mu.RLock()
+	unchanged := info.ModTime().Equal(x.modTime)
+	x.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	rules, err := LoadRules(x.path)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.rules = rules
+	x.modTime = info.ModTime()
+	x.loadedAt = time.Now()
+	x.mu.Unlock()
+	log.Info().Str("component", "rules").Str("path", x.path).Int("rules", len(rules)).Msg("loaded")
+	return nil
+}
+
+// Check the file every interval until Close.
+func (x *RulesEngine) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := x.Reload(); err != nil && !os.IsNotExist(err) {
+					log.Warn().Err(err).Str("component", "rules").Str("path", x.path).Int("rules", x.Len()).
+						Time("loaded", x.LoadedAt()).Msg("reload failed, keeping the rules loaded before")
+				}
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *RulesEngine) Close() {
+	x.once.Do(func() { close(x.stop) })
+}
+
+func (x *RulesEngine) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.rules)
+}
+
+// When the rules in force were read, zero when there are none from a file.
+func (x *RulesEngine) LoadedAt() time.Time {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.loadedAt
+}
+
+func (x *RulesEngine) Evaluate(facts Facts) Decision {
+	x.mu.RLock()
+	rules := x.rules
+	x.mu.RUnlock()
+
+	decision := Decision{Sync: SYNC_ALLOW}
+	syncSet := false
+	for _, rule := range rules {
+		if !rule.Match.Matches(facts) {
+			continue
+		}
+		decision.Matched = append(decision.Matched, rule.Name)
+		if rule.Action.Sync != "" && !syncSet {
+			decision.Sync = rule.Action.Sync
+			syncSet = true
+		}
+		if rule.Action.Redirect != "" && decision.Redirect == "" {
+			decision.Redirect = rule.Action.Redirect
+		}
+		decision.SuppressMacros = append(decision.SuppressMacros, rule.Action.SuppressMacros...)
+		decision.Tags = append(decision.Tags, rule.Action.Tags...)
+		if rule.Stop {
+			break
+		}
+	}
+	return decision
+}
+
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set RuleSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	for i, rule := range set.Rules {
+		switch rule.Action.Sync {
+		case "", SYNC_ALLOW, SYNC_DENY:
+		default:
+			return nil, fmt.Errorf("%w: rule %d %q sync %q", ErrInvalidRule, i, rule.Name, rule.Action.Sync)
+		}
+	}
+	return set.Rules, nil
+}
+
+func (x Match) Matches(facts Facts) bool {
+	return anyOf(x.Partners, facts.PartnerID) &&
+		anyOf(x.Countries, facts.Country) &&
+		anyOf(x.Regions, facts.Region) &&
+		anyASN(x.ASNs, facts.ASN) &&
+		boolIs(x.GDPR, facts.GDPRApplies) &&
+		boolIs(x.Consent, facts.Consent) &&
+		anyOf(x.Traffic, facts.Traffic) &&
+		anyOf(x.Anonymizers, facts.Anonymizer) &&
+		anyOf(x.DeviceTypes, facts.DeviceType) &&
+		anyOf(x.BrowserFamilies, facts.BrowserFamily) &&
+		anyOf(x.OSFamilies, facts.OSFamily) &&
+		boolIs(x.NewCookie, facts.NewCookie) &&
+		(x.MinCookieAge == nil || facts.CookieAge >= x.MinCookieAge.Duration) &&
+		(x.MaxCookieAge == nil || facts.CookieAge <= x.MaxCookieAge.Duration)
+}
+
+func anyOf(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyASN(values []uint, value uint) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func boolIs(want *bool, value bool) bool {
+	return want == nil || *want == value
+}
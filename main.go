@@ -2,10 +2,16 @@
 package main
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
 
+	"github.com/osintami/monster/engine"
 	"github.com/osintami/monster/server"
 	"github.com/osintami/monster/utils"
 	"github.com/osintami/plumbr/sink"
@@ -15,31 +21,165 @@ func main() {
 	svrConfig := utils.ServerConfig{}
 	sink.LoadEnv(&svrConfig)
 	sink.InitLogger(svrConfig.LogLevel)
+	if err := server.ValidateConfig(svrConfig); err != nil {
+		log.Fatal().Err(err).Str("component", "monster").Msg("config")
+	}
+	secrets := LoadSecrets()
+	DgraphCredentials(&svrConfig, secrets)
+
+	if len(os.Args) > 1 {
+		if err := RunCommand(svrConfig, os.Args[1:]); err != nil {
+			log.Fatal().Err(err).Str("component", "monster").Msg(strings.Join(os.Args[1:], " "))
+		}
+		return
+	}
+
+	store, graph, err := openStore(svrConfig)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "monster").Msg("identity store")
+	}
+	// never sync into a graph older than this binary, run monster migrate up first.  Without
+	// GRAPH_SYNC only the admin requests touch it, a stale schema is logged and the server starts.
+	if graph != nil {
+		report := log.Fatal
+		if !svrConfig.GraphSync {
+			report = log.Warn
+		}
+		if err := graph.CheckSchemaVersion(context.Background(), utils.Migrations); err != nil {
+			report().Err(err).Str("component", "monster").Msg("schema")
+		} else if err := graph.CheckSchema(context.Background()); err != nil {
+			report().Err(err).Str("component", "monster").Msg("schema")
+		}
+	}
 
 	// TODO:  make this configuration driven between DynamoDB, Redis, etc.
-	cache := sink.NewFastCache(svrConfig.FSPath + "cache.db")
-	cache.LoadFile()
+	cache := utils.NewFileCache(svrConfig.FSPath+"cache.db", svrConfig.CacheJournal)
 
 	shutdown := sink.NewShutdownHandler()
-	shutdown.AddListener(cache.SaveFile)
-	shutdown.Listen()
+
+	rules := engine.NewRulesEngine(svrConfig.FSPath + svrConfig.RulesFile)
+	rules.Watch(svrConfig.RulesReload)
+
+	// retention sweeps the graph, Validate refuses a window on the sql store
+	var retention *utils.RetentionSweeper
+	if graph != nil {
+		retention = utils.NewRetentionSweeper(graph, svrConfig.RetentionWindow, svrConfig.RetentionBatch, svrConfig.RetentionDryRun)
+		retention.Start(svrConfig.RetentionInterval)
+	}
+
+	reconciler := utils.NewReconciler(store, auditPath(svrConfig), svrConfig.ReconcileBatch)
+	reconciler.Start(svrConfig.ReconcileInterval)
 
 	core := utils.ServerCore{
 		Config:   svrConfig,
 		Cache:    cache,
-		Secrets:  LoadSecrets(),
+		Graph:    reconciler,
+		Secrets:  secrets,
 		Shutdown: shutdown,
-		//Rules:    engine.NewRulesEngine(svrConfig.FSPath),
+		Rules:    rules,
 	}
 
 	in := server.NewServer(core)
 
 	router := chi.NewMux()
+	router.Get("/healthz", in.Healthz)
+	router.Get("/readyz", in.Readyz)
 	router.Route(svrConfig.PathPrefix, func(r chi.Router) {
-		r.Get("/csr", in.CookieSync)
+		r.With(in.RequireCacheLoaded).Get("/csr", in.CookieSync)
+	})
+	if svrConfig.AdminToken != "" {
+		router.Route("/admin", func(r chi.Router) {
+			r.Use(in.AdminAuth)
+			// an erasure before the snapshot loads would be undone by it, an export would miss entries
+			r.With(in.RequireCacheLoaded).Get("/identity", in.ExportIdentity)
+			r.With(in.RequireCacheLoaded).Delete("/identity", in.EraseIdentity)
+			r.Get("/stats/traffic", in.TrafficStats)
+		})
+	}
+
+	httpServer := &http.Server{Addr: svrConfig.ListenAddr, Handler: router}
+	var redirectServer *http.Server
+	var certs *utils.CertReloader
+	if svrConfig.TLSCertFile != "" {
+		certs, err = utils.NewCertReloader(svrConfig.TLSCertFile, svrConfig.TLSKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("component", "monster").Msg("tls")
+		}
+		certs.Watch(svrConfig.TLSReloadInterval)
+		httpServer.TLSConfig = certs.TLSConfig()
+		if svrConfig.RedirectAddr != "" {
+			redirectServer = &http.Server{Addr: svrConfig.RedirectAddr, Handler: server.HTTPSRedirect(svrConfig.ListenAddr)}
+		}
+	}
+	stopped := make(chan struct{})
+
+	// order matters:  stop accepting and drain handlers, then drain graph writes, then snapshot
+	shutdown.AddListener(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), svrConfig.ShutdownTimeout)
+		defer cancel()
+		if redirectServer != nil {
+			redirectServer.Shutdown(ctx)
+		}
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Str("component", "monster").Msg("http shutdown")
+		}
+		if certs != nil {
+			certs.Close()
+		}
+		rules.Close()
+		if retention != nil {
+			retention.Close()
+		}
+		reconciler.Close()
+		in.Close()
+	})
+	shutdown.AddListener(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), svrConfig.ShutdownTimeout)
+		defer cancel()
+		if err := in.Flush(ctx); err != nil {
+			log.Error().Err(err).Str("component", "monster").Msg("graph flush")
+		}
+		// the queue is drained, nothing writes to the store any more
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	// never snapshot a cache that is still loading, it would truncate cache.db
+	shutdown.AddListener(func() {
+		if in.IsCacheLoaded() {
+			cache.SaveFile()
+		}
+		cache.Close()
+		close(stopped)
 	})
+	shutdown.Listen()
+
+	// readiness flips once the cache is warm, liveness answers immediately
+	go func() {
+		if err := cache.LoadFile(); err != nil {
+			log.Fatal().Err(err).Str("component", "monster").Msg("load cache")
+		}
+		in.CacheLoaded()
+		cache.StartSnapshots(svrConfig.SnapshotInterval)
+	}()
+
+	if redirectServer != nil {
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal().Err(err).Str("component", "monster").Msg("listen redirect")
+			}
+		}()
+	}
 
-	http.ListenAndServe(svrConfig.ListenAddr, router)
+	if httpServer.TLSConfig != nil {
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal().Err(err).Str("component", "monster").Msg("listen")
+	}
+	<-stopped
 }
 
 func LoadSecrets() *sink.SecretsManager {
@@ -48,3 +188,13 @@ func LoadSecrets() *sink.SecretsManager {
 		"DGRAPH_PASS"}
 	return sink.NewSecretsManager(keys)
 }
+
+// The Dgraph login comes from the secrets manager, the environment only when it has none.
+func DgraphCredentials(cfg *utils.ServerConfig, secrets *sink.SecretsManager) {
+	if user := secrets.Get("DGRAPH_USER"); user != "" {
+		cfg.DgraphUser = user
+	}
+	if pass := secrets.Get("DGRAPH_PASS"); pass != "" {
+		cfg.DgraphPass = pass
+	}
+}
@@ -0,0 +1,33 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Bearer token check for the /admin routes, everything is refused while no token is configured.
+func (x *MonsterServer) AdminAuth(next http.Handler) http.Handler {
+	token := []byte(x.core.Config.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if len(token) == 0 || subtle.ConstantTimeCompare(given, token) != 1 {
+			log.Warn().Str("component", "admin").Str("client", x.ClientIP(r)).Str("path", r.URL.Path).Msg("unauthorized")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn().Err(err).Str("component", "admin").Msg("encode")
+	}
+}
@@ -0,0 +1,96 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+)
+
+const (
+	ANONYMIZER_TOR = "tor"
+	ANONYMIZER_VPN = "vpn"
+)
+
+// Tor exit nodes and VPN/proxy ranges from local files, reloaded on a schedule.
+type AnonymizerSet struct {
+	torFiles []string
+	vpnFiles []string
+	mu       sync.RWMutex
+	tor      *netaddr.IPSet
+	vpn      *netaddr.IPSet
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func NewAnonymizerSet(torFiles, vpnFiles []string) (*AnonymizerSet, error) {
+	x := &AnonymizerSet{
+		torFiles: torFiles,
+		vpnFiles: vpnFiles,
+		stop:     make(chan struct{})}
+	if err := x.Reload(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Rebuild both sets from disk, the old sets stay in use if a file cannot be read.
+func (x *AnonymizerSet) Reload() error {
+	tor, err := LoadIPSet(x.torFiles)
+	if err != nil {
+		log.Error().Err(err).Str("component", "anonymizer").Msg("load tor exits")
+		return err
+	}
+	vpn, err := LoadIPSet(x.vpnFiles)
+	if err != nil {
+		log.Error().Err(err).Str("component", "anonymizer").Msg("load vpn ranges")
+		return err
+	}
+	x.mu.Lock()
+	x.tor = tor
+	x.vpn = vpn
+	x.mu.Unlock()
+	return nil
+}
+
+// Reload every interval until Close.
+func (x *AnonymizerSet) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				x.Reload()
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *AnonymizerSet) Close() {
+	x.once.Do(func() { close(x.stop) })
+}
+
+// The anonymizer network the client address belongs to, empty when it is a direct connection.
+func (x *AnonymizerSet) Classify(clientIP string) string {
+	ip, ok := ParseClientIP(clientIP)
+	if !ok {
+		return ""
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.tor.Contains(ip) {
+		return ANONYMIZER_TOR
+	}
+	if x.vpn.Contains(ip) {
+		return ANONYMIZER_VPN
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymizerClassify(t *testing.T) {
+	dir := t.TempDir()
+	torFile := filepath.Join(dir, "tor_exits.txt")
+	vpnFile := filepath.Join(dir, "vpn_cidrs.txt")
+	os.WriteFile(torFile, []byte("185.220.101.1\n"), 0600)
+	os.WriteFile(vpnFile, []byte("146.70.0.0/16\n"), 0600)
+
+	anonymizer, err := NewAnonymizerSet([]string{torFile}, []string{vpnFile, filepath.Join(dir, "missing.txt")})
+	assert.NoError(t, err)
+	defer anonymizer.Close()
+
+	assert.Equal(t, ANONYMIZER_TOR, anonymizer.Classify("185.220.101.1"))
+	assert.Equal(t, ANONYMIZER_VPN, anonymizer.Classify("146.70.12.4"))
+	assert.Equal(t, "", anonymizer.Classify("220.120.12.13"))
+	assert.Equal(t, "", anonymizer.Classify("not-an-ip"))
+
+	// the exit list rotates, the next reload picks it up
+	os.WriteFile(torFile, []byte("185.220.101.2\n"), 0600)
+	assert.NoError(t, anonymizer.Reload())
+	assert.Equal(t, "", anonymizer.Classify("185.220.101.1"))
+	assert.Equal(t, ANONYMIZER_TOR, anonymizer.Classify("185.220.101.2"))
+}
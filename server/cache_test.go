@@ -0,0 +1,140 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/osintami/monster/utils"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	ci := InitCookieInfo(t)
+
+	cache := utils.NewFileCache(path, false)
+	assert.Equal(t, utils.ErrCacheNotLoaded, cache.SaveFile())
+	assert.NoError(t, cache.LoadFile())
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+	cache.Set("expired", ci, time.Nanosecond)
+	assert.NoError(t, cache.SaveFile())
+	assert.NoError(t, cache.Close())
+
+	_, err := os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	restored := utils.NewFileCache(path, false)
+	assert.NoError(t, restored.LoadFile())
+	value, ok := restored.Get(ci.MyCookieID)
+	assert.True(t, ok)
+	assert.Equal(t, ci, value)
+	_, ok = restored.Get("expired")
+	assert.False(t, ok)
+}
+
+func TestCacheLegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	ci := InitCookieInfo(t)
+
+	legacy := gocache.New(gocache.NoExpiration, time.Minute)
+	legacy.Set(ci.MyCookieID, ci, gocache.NoExpiration)
+	assert.NoError(t, legacy.SaveFile(path))
+	cache := utils.NewFileCache(path, false)
+	assert.NoError(t, cache.LoadFile())
+	value, ok := cache.Get(ci.MyCookieID)
+	assert.True(t, ok)
+	assert.Equal(t, ci, value)
+
+	// neither format, start empty and keep the file
+	assert.NoError(t, os.WriteFile(path, []byte("not a snapshot"), 0600))
+	cache = utils.NewFileCache(path, false)
+	assert.NoError(t, cache.LoadFile())
+	assert.Empty(t, cache.Items())
+	aside, _ := filepath.Glob(path + ".corrupt.*")
+	assert.Equal(t, 1, len(aside))
+	assert.NoError(t, cache.SaveFile())
+}
+
+func TestCacheJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	ci := InitCookieInfo(t)
+
+	cache := utils.NewFileCache(path, true)
+	assert.NoError(t, cache.LoadFile())
+	cache.Set("before", ci, time.Hour)
+	assert.NoError(t, cache.SaveFile())
+	ci.PartnerID = "after-snapshot"
+	cache.Set("after", ci, time.Hour)
+	// crash, no final snapshot
+	assert.NoError(t, cache.Close())
+
+	restored := utils.NewFileCache(path, true)
+	assert.NoError(t, restored.LoadFile())
+	defer restored.Close()
+	_, ok := restored.Get("before")
+	assert.True(t, ok)
+	value, ok := restored.Get("after")
+	assert.True(t, ok)
+	assert.Equal(t, "after-snapshot", value.(CookieInfo).PartnerID)
+}
+
+func TestCacheJournalTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	ci := InitCookieInfo(t)
+
+	cache := utils.NewFileCache(path, true)
+	assert.NoError(t, cache.LoadFile())
+	cache.Set("first", ci, time.Hour)
+	assert.NoError(t, cache.Close())
+
+	// half written record at the end of the journal
+	fh, err := os.OpenFile(path+".journal", os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	fh.Write([]byte{0, 0, 1, 0, 42})
+	fh.Close()
+
+	restored := utils.NewFileCache(path, true)
+	assert.NoError(t, restored.LoadFile())
+	restored.Set("second", ci, time.Hour)
+	assert.NoError(t, restored.Close())
+
+	again := utils.NewFileCache(path, true)
+	assert.NoError(t, again.LoadFile())
+	defer again.Close()
+	_, ok := again.Get("first")
+	assert.True(t, ok)
+	_, ok = again.Get("second")
+	assert.True(t, ok)
+}
+
+func TestCacheRetentionWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache := utils.NewFileCache(path, true)
+	assert.NoError(t, cache.LoadFile())
+	in := NewServer(utils.ServerCore{Config: utils.ServerConfig{RetentionWindow: 50 * time.Millisecond}, Cache: cache})
+	assert.Equal(t, 50*time.Millisecond, in.CacheTTL())
+
+	ci := InitCookieInfo(t)
+	in.SyncCookie(ci)
+	ci.MyCookieID = "still-active"
+	in.SyncCookie(ci)
+	time.Sleep(30 * time.Millisecond)
+	in.SyncCookie(ci)
+	time.Sleep(30 * time.Millisecond)
+
+	assert.NoError(t, cache.SaveFile())
+	assert.NoError(t, cache.Close())
+	_, ok := cache.Get("test-my-cookie-id")
+	assert.False(t, ok)
+
+	restored := utils.NewFileCache(path, true)
+	assert.NoError(t, restored.LoadFile())
+	defer restored.Close()
+	assert.Equal(t, 1, len(restored.Items()))
+	_, ok = restored.Get("still-active")
+	assert.True(t, ok)
+}
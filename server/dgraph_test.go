@@ -3,7 +3,11 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/osintami/monster/utils"
 	"github.com/stretchr/testify/assert"
@@ -50,7 +54,7 @@ func TestDeleteCookie(t *testing.T) {
 	cookie, err := dg.FindCookie(ctx, nil, "xyz123")
 	assert.Equal(t, utils.ErrCookieNotFound, err)
 	err = dg.DeleteCookie(ctx, nil, cookie, true)
-	assert.Nil(t, err)
+	assert.Equal(t, utils.ErrCookieNotFound, err)
 }
 
 func TestSaveBrowser(t *testing.T) {
@@ -135,6 +139,194 @@ func TestCollapseBrowser(t *testing.T) {
 
 }
 
+func TestLinkCookieAnonymizer(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+
+	browser := utils.Browser{Addr: "185.220.101.1", UserAgent: "test-user-agent", Anonymizer: "tor"}
+	partner := utils.Partner{PartnerID: "pdq123", CookieID: "xyz456"}
+	cookie1, err := dg.LinkCookie(ctx, "xyz123", browser, partner, nil)
+	assert.NoError(t, err)
+	cookie2, err := dg.LinkCookie(ctx, "abc789", browser, partner, nil)
+	assert.NoError(t, err)
+
+	// same ua and ip, but through tor, so two browsers
+	cookie1, err = dg.FindCookie(ctx, nil, cookie1.CookieID)
+	assert.NoError(t, err)
+	cookie2, err = dg.FindCookie(ctx, nil, cookie2.CookieID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cookie1.Browsers[0].Uid, cookie2.Browsers[0].Uid)
+
+	_, err = dg.FindBrowser(ctx, nil, "test-user-agent", "185.220.101.1")
+	assert.Equal(t, utils.ErrBrowserNotFound, err)
+}
+
+func TestLinkCookieBrowserUpdate(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+
+	old := utils.Browser{Addr: "220.120.12.13", UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36"}
+	old.SetUserAgent(utils.ParseUserAgent(old.UserAgent))
+	_, err := dg.LinkCookie(ctx, "xyz123", old, utils.Partner{}, nil)
+	assert.NoError(t, err)
+
+	// a minor chrome update is the same browser
+	updated := utils.Browser{Addr: "220.120.12.13", UserAgent: CHROME_UA}
+	updated.SetUserAgent(utils.ParseUserAgent(updated.UserAgent))
+	_, err = dg.LinkCookie(ctx, "xyz123", updated, utils.Partner{}, nil)
+	assert.NoError(t, err)
+
+	cookie, err := dg.FindCookie(ctx, nil, "xyz123")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cookie.Browsers))
+	assert.Equal(t, 108, cookie.Browsers[0].BrowserMajor)
+	assert.Equal(t, CHROME_UA, cookie.Browsers[0].UserAgent)
+}
+
+func TestLinkCookieFacets(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+
+	browser := utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"}
+	partner := utils.Partner{PartnerID: "pdq123", CookieID: "xyz456"}
+	_, err := dg.LinkCookie(ctx, "xyz123", browser, partner, nil)
+	assert.NoError(t, err)
+	_, err = dg.LinkCookie(ctx, "xyz123", browser, utils.Partner{PartnerID: "abc999", CookieID: "p2"}, nil)
+	assert.NoError(t, err)
+	_, err = dg.LinkCookie(ctx, "xyz123", browser, partner, nil)
+	assert.NoError(t, err)
+
+	cookie, err := dg.FindCookie(ctx, nil, "xyz123")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cookie.Browsers))
+	b := cookie.Browsers[0]
+	assert.Equal(t, 3, b.Hits)
+	assert.Equal(t, "pdq123", b.Source)
+	assert.True(t, b.LastSeen.After(*b.FirstSeen))
+	assert.Equal(t, 2, len(cookie.Partners))
+	for _, p := range cookie.Partners {
+		assert.Equal(t, p.PartnerID, p.Source)
+		if p.PartnerID == "pdq123" {
+			assert.Equal(t, 2, p.Hits)
+		} else {
+			assert.Equal(t, 1, p.Hits)
+		}
+	}
+}
+
+func TestEdgeFacetsTouch(t *testing.T) {
+	first := time.Now()
+	browser := utils.Browser{Uid: "0x1"}
+	browser.Touch(first, "")
+	browser.Touch(first.Add(time.Minute), "pdq123")
+	browser.Touch(first.Add(time.Hour), "abc999")
+	assert.Equal(t, 3, browser.Hits)
+	assert.Equal(t, first, *browser.FirstSeen)
+	assert.Equal(t, first.Add(time.Hour), *browser.LastSeen)
+	assert.Equal(t, "pdq123", browser.Source)
+
+	// facets ride on the edge, dgraph reads them from predicate|facet keys on the child
+	pb, err := json.Marshal(utils.Cookie{Browsers: []utils.Browser{browser}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(pb), `"browser|count":3`)
+	assert.Contains(t, string(pb), `"browser|source":"pdq123"`)
+}
+
+func TestMigrate(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+
+	status, err := dg.MigrationStatus(ctx, utils.Migrations)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.LatestVersion(utils.Migrations), status.Current)
+	assert.Empty(t, status.Pending)
+	assert.NoError(t, dg.CheckSchemaVersion(ctx, utils.Migrations))
+
+	applied, err := dg.Migrate(ctx, utils.Migrations)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	next := append(utils.Migrations, utils.Migration{Version: status.Latest + 1, Name: "next"})
+	assert.ErrorIs(t, dg.CheckSchemaVersion(ctx, next), utils.ErrSchemaBehind)
+}
+
+func TestEraseCookie(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+
+	shared := utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"}
+	own := utils.Browser{Addr: "220.120.12.14", UserAgent: "test-user-agent",
+		Enrichments: []utils.Enrichment{{Enricher: "test", Attribute: utils.BoolAttr("risky", true)}}}
+	_, err := dg.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+	assert.NoError(t, err)
+	_, err = dg.LinkCookie(ctx, "xyz123", own, utils.Partner{}, nil)
+	assert.NoError(t, err)
+	_, err = dg.LinkCookie(ctx, "abc789", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p2"}, nil)
+	assert.NoError(t, err)
+
+	ids, err := dg.FindCookieIDsByPartner(ctx, "p1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"xyz123"}, ids)
+
+	erased, err := dg.EraseCookie(ctx, "xyz123")
+	assert.NoError(t, err)
+	types := map[string]int{}
+	for _, node := range erased {
+		types[node.Type]++
+	}
+	// the shared browser stays for abc789
+	assert.Equal(t, map[string]int{"Cookie": 1, "Browser": 1, "Enrichment": 1, "Partner": 1}, types)
+
+	_, err = dg.FindCookie(ctx, nil, "xyz123")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+	_, err = dg.FindBrowser(ctx, nil, "test-user-agent", "220.120.12.14")
+	assert.Equal(t, utils.ErrBrowserNotFound, err)
+	cookie, err := dg.FindCookie(ctx, nil, "abc789")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cookie.Browsers))
+
+	_, err = dg.EraseCookie(ctx, "xyz123")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+}
+
+func TestSweepDormant(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+
+	shared := utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"}
+	own := utils.Browser{Addr: "220.120.12.14", UserAgent: "test-user-agent",
+		Enrichments: []utils.Enrichment{{Enricher: "test", Attribute: utils.BoolAttr("risky", true)}}}
+	_, err := dg.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+	assert.NoError(t, err)
+	_, err = dg.LinkCookie(ctx, "xyz123", own, utils.Partner{}, nil)
+	assert.NoError(t, err)
+	// created and never synced, it still has a seen to expire on
+	_, err = dg.CreateCookie(ctx, nil, &utils.Cookie{Uid: "_:cookie", CookieID: "ghi000"}, true)
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, err = dg.LinkCookie(ctx, "abc789", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p2"}, nil)
+	assert.NoError(t, err)
+
+	report, err := dg.SweepDormant(ctx, cutoff, 1, true)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 2, report.Cookies)
+	assert.Equal(t, 1, report.Browsers)
+	assert.Equal(t, 1, report.Enrichments)
+	assert.Equal(t, 1, report.Partners)
+	_, err = dg.FindCookie(ctx, nil, "xyz123")
+	assert.NoError(t, err)
+
+	report, err = dg.SweepDormant(ctx, cutoff, 1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Cookies)
+	assert.Equal(t, 1, report.Browsers)
+	_, err = dg.FindCookie(ctx, nil, "xyz123")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+	_, err = dg.FindCookie(ctx, nil, "ghi000")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+	cookie, err := dg.FindCookie(ctx, nil, "abc789")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cookie.Browsers))
+	assert.NotNil(t, cookie.SeenAt)
+}
+
 // func TestNewCookie(t *testing.T) {
 
 // }
@@ -143,11 +335,77 @@ func TestCollapseBrowser(t *testing.T) {
 
 // }
 
-func InitDgraph(t *testing.T) (*utils.Dgraph, context.Context) {
-	cfg := utils.ServerConfig{DgraphSvr: "localhost:9080"}
-	dg := utils.NewDgraph(cfg)
+// Sync path lookups in their own read-only txn against the read-write txn they used to open,
+// while a writer keeps syncing the same cookie.  Needs a live alpha:
+// go test -run XXX -bench FindCookie ./server/
+func BenchmarkFindCookie(b *testing.B) {
+	dg, ctx := InitDgraph(b)
+	browser := utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"}
+	partner := utils.Partner{PartnerID: "pdq123", CookieID: "xyz456"}
+	_, err := dg.LinkCookie(ctx, "xyz123", browser, partner, nil)
+	assert.NoError(b, err)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				dg.LinkCookie(ctx, "xyz123", browser, partner, nil)
+			}
+		}
+	}()
+
+	lookups := []struct {
+		name string
+		find func() error
+	}{
+		{"read-only", func() error {
+			_, err := dg.FindCookie(ctx, nil, "xyz123")
+			return err
+		}},
+		{"read-write", func() error {
+			txn := dg.NewTxn()
+			defer txn.Discard(ctx)
+			_, err := dg.FindCookie(ctx, txn, "xyz123")
+			return err
+		}},
+	}
+	for _, lookup := range lookups {
+		b.Run(lookup.name, func(b *testing.B) {
+			var mu sync.Mutex
+			latencies := []time.Duration{}
+			b.RunParallel(func(pb *testing.PB) {
+				mine := []time.Duration{}
+				for pb.Next() {
+					start := time.Now()
+					if err := lookup.find(); err != nil {
+						b.Error(err)
+					}
+					mine = append(mine, time.Since(start))
+				}
+				mu.Lock()
+				latencies = append(latencies, mine...)
+				mu.Unlock()
+			})
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			if len(latencies) > 0 {
+				b.ReportMetric(float64(latencies[len(latencies)/2]), "p50-ns")
+				b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+			}
+		})
+	}
+}
+
+func InitDgraph(t testing.TB) (*utils.Dgraph, context.Context) {
+	cfg := utils.ServerConfig{DgraphSvrs: []string{"localhost:9080"}}
+	dg, err := utils.NewDgraph(cfg)
+	assert.NoError(t, err)
+	t.Cleanup(func() { dg.Close() })
 	ctx := context.Background()
-	err := dg.DropSchema(ctx)
+	err = dg.DropSchema(ctx)
 	assert.NoError(t, err)
 	err = dg.CreateSchema(ctx)
 	assert.NoError(t, err)
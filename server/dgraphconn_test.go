@@ -0,0 +1,168 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Answers logins for groot and, with acl, only queries that carry the token it handed out.
+// The first aborts mutations fail the way a conflicting writer makes them fail, and every
+// request takes delay to answer.
+type fakeAlpha struct {
+	api.UnimplementedDgraphServer
+	mu        sync.Mutex
+	acl       bool
+	aborts    int
+	delay     time.Duration
+	logins    int
+	queries   int
+	readOnly  int
+	mutations int
+	commits   int
+}
+
+func (x *fakeAlpha) Login(ctx context.Context, req *api.LoginRequest) (*api.Response, error) {
+	if req.Userid != "groot" || req.Password != "password" {
+		return nil, errors.New("invalid username or password")
+	}
+	x.mu.Lock()
+	x.logins++
+	x.mu.Unlock()
+	pb, err := (&api.Jwt{AccessJwt: "access", RefreshJwt: "refresh"}).Marshal()
+	return &api.Response{Json: pb}, err
+}
+
+func (x *fakeAlpha) Query(ctx context.Context, req *api.Request) (*api.Response, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if x.acl && (len(md.Get("accessJwt")) == 0 || md.Get("accessJwt")[0] != "access") {
+		return nil, errors.New("no accessJwt available")
+	}
+	x.mu.Lock()
+	delay := x.delay
+	x.mu.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.queries++
+	if req.ReadOnly && req.BestEffort {
+		x.readOnly++
+	}
+	if len(req.Mutations) > 0 {
+		x.mutations++
+		if x.aborts > 0 {
+			x.aborts--
+			return nil, status.Error(codes.Aborted, "Transaction has been aborted. Please retry")
+		}
+		return &api.Response{Txn: &api.TxnContext{StartTs: 1}, Uids: map[string]string{"cookie": "0x1"}}, nil
+	}
+	return &api.Response{Json: []byte(`{"all":[]}`), Txn: &api.TxnContext{StartTs: 1}}, nil
+}
+
+func (x *fakeAlpha) CommitOrAbort(ctx context.Context, txn *api.TxnContext) (*api.TxnContext, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !txn.Aborted {
+		x.commits++
+	}
+	return txn, nil
+}
+
+// A fake Alpha behind mutual TLS, the client must present clientCert.
+func startAlpha(t *testing.T, serverCert, serverKey, clientCert string) (*fakeAlpha, string) {
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	assert.NoError(t, err)
+	pem, err := os.ReadFile(clientCert)
+	assert.NoError(t, err)
+	clients := x509.NewCertPool()
+	clients.AppendCertsFromPEM(pem)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: clients, ClientAuth: tls.RequireAndVerifyClientCert}
+
+	alpha := &fakeAlpha{acl: true}
+	return alpha, serveAlpha(t, alpha, grpc.Creds(credentials.NewTLS(config)))
+}
+
+func serveAlpha(t *testing.T, alpha *fakeAlpha, opts ...grpc.ServerOption) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := grpc.NewServer(opts...)
+	api.RegisterDgraphServer(srv, alpha)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestNewDgraph(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "alpha.crt"), filepath.Join(dir, "alpha.key")
+	clientCert, clientKey := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	WriteTestCert(t, serverCert, serverKey, "alpha")
+	WriteTestCert(t, clientCert, clientKey, "monster")
+	first, firstAddr := startAlpha(t, serverCert, serverKey, clientCert)
+	second, secondAddr := startAlpha(t, serverCert, serverKey, clientCert)
+
+	cfg := utils.ServerConfig{
+		DgraphSvrs:       []string{firstAddr, secondAddr},
+		DgraphACL:        true,
+		DgraphUser:       "groot",
+		DgraphPass:       "password",
+		DgraphTLS:        true,
+		DgraphCACert:     serverCert,
+		DgraphClientCert: clientCert,
+		DgraphClientKey:  clientKey,
+		DgraphServerName: "alpha"}
+	graph, err := utils.NewDgraph(cfg)
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, graph.Ping(context.Background()))
+	}
+	assert.NoError(t, graph.Close())
+	assert.Equal(t, 1, first.logins+second.logins)
+	// requests are spread over both alphas
+	assert.NotZero(t, first.queries)
+	assert.NotZero(t, second.queries)
+
+	bad := cfg
+	bad.DgraphPass = "wrong"
+	_, err = utils.NewDgraph(bad)
+	assert.Error(t, err)
+	bad.DgraphPass = ""
+	_, err = utils.NewDgraph(bad)
+	assert.Equal(t, utils.ErrDgraphCredentials, err)
+
+	// the alphas turn away a client without a certificate
+	anonymous := cfg
+	anonymous.DgraphClientCert, anonymous.DgraphClientKey = "", ""
+	_, err = utils.NewDgraph(anonymous)
+	assert.Error(t, err)
+
+	untrusted := cfg
+	untrusted.DgraphCACert = clientKey
+	_, err = utils.NewDgraph(untrusted)
+	assert.Equal(t, utils.ErrDgraphCA, err)
+
+	_, err = utils.NewDgraph(utils.ServerConfig{})
+	assert.Equal(t, utils.ErrNoDgraphEndpoints, err)
+}
@@ -0,0 +1,130 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/osintami/monster/utils"
+)
+
+const (
+	DSAR_FORMAT     = "monster-dsar"
+	DSAR_VERSION    = 1
+	CONSENT_HISTORY = 32
+)
+
+// One consent signal as a partner passed it on a sync.
+type ConsentRecord struct {
+	At          time.Time `json:"at"`
+	PartnerID   string    `json:"pid"`
+	GDPRApplies bool      `json:"gdpr"`
+	Consent     string    `json:"gdpr_consent,omitempty"`
+}
+
+// Append record unless it repeats the latest one from the same partner, keeping the newest CONSENT_HISTORY.
+func RecordConsent(history []ConsentRecord, record ConsentRecord) []ConsentRecord {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].PartnerID != record.PartnerID {
+			continue
+		}
+		if history[i].GDPRApplies == record.GDPRApplies && history[i].Consent == record.Consent {
+			return history
+		}
+		break
+	}
+	history = append(history, record)
+	if len(history) > CONSENT_HISTORY {
+		history = history[len(history)-CONSENT_HISTORY:]
+	}
+	return history
+}
+
+// Everything held under one of our cookie ids.
+type DSARIdentity struct {
+	CookieID       string          `json:"cookie_id"`
+	Graph          *utils.Cookie   `json:"graph,omitempty"`
+	Cache          *CookieInfo     `json:"cache,omitempty"`
+	ConsentHistory []ConsentRecord `json:"consent_history"`
+}
+
+// A data subject access export, GDPR Article 15.
+type DSARExport struct {
+	Format      string            `json:"format"`
+	Version     int               `json:"version"`
+	Subject     string            `json:"subject"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Sections    map[string]string `json:"sections"`
+	Identities  []DSARIdentity    `json:"identities"`
+}
+
+// describes the document to whoever receives it
+var dsarSections = map[string]string{
+	"identities":                 "one entry per first-party cookie id we associate with the subject",
+	"identities.graph":           "the identity graph: the cookie, the browsers (address, user-agent, location, enrichments) and partner cookie ids linked to it",
+	"identities.graph.browser":   "devices seen with the cookie, enrichment entries name the source and time of each derived attribute",
+	"identities.graph.partner":   "partner ids and the partner's own cookie id for the subject",
+	"identities.cache":           "the latest sync as held in the fast lookup cache",
+	"identities.consent_history": "consent signals partners passed with syncs, oldest first",
+}
+
+// Collect the graph and cache data for a person.  Internal node ids are left out, graph may be nil.
+func ExportSubject(ctx context.Context, cache utils.ICache, graph utils.IdentityStore, by string, value string) (*DSARExport, error) {
+	muids, err := ResolveSubject(ctx, cache, graph, by, value)
+	if err != nil {
+		return nil, err
+	}
+	export := &DSARExport{
+		Format:      DSAR_FORMAT,
+		Version:     DSAR_VERSION,
+		Subject:     by + ":" + value,
+		GeneratedAt: time.Now().UTC(),
+		Sections:    dsarSections,
+		Identities:  []DSARIdentity{}}
+
+	for _, muid := range muids {
+		identity := DSARIdentity{CookieID: muid, ConsentHistory: []ConsentRecord{}}
+		if graph != nil {
+			cookie, err := graph.FindCookie(ctx, muid)
+			if err != nil && err != utils.ErrCookieNotFound && err != utils.ErrDuplicateCookiesExist {
+				return nil, err
+			}
+			if cookie != nil {
+				cookie.Redact()
+				identity.Graph = cookie
+			}
+		}
+		if item, ok := cache.Get(muid); ok {
+			if ci, ok := item.(CookieInfo); ok {
+				identity.Cache = &ci
+				identity.ConsentHistory = append(identity.ConsentHistory, ci.Consents...)
+			}
+		}
+		if identity.Graph == nil && identity.Cache == nil {
+			continue
+		}
+		export.Identities = append(export.Identities, identity)
+	}
+	return export, nil
+}
+
+// GET /admin/identity?muid=|pcid=|hem= answers with the access export.
+func (x *MonsterServer) ExportIdentity(w http.ResponseWriter, r *http.Request) {
+	by, value := subjectParam(r)
+	export, err := ExportSubject(r.Context(), x.core.Cache, x.core.Graph, by, value)
+	if errors.Is(err, ErrSubject) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "dsar").Str("by", by).Msg("export")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Info().Str("component", "dsar").Str("by", by).Int("identities", len(export.Identities)).Msg("exported")
+	writeJSON(w, http.StatusOK, export)
+}
@@ -0,0 +1,137 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieSyncConsentHistory(t *testing.T) {
+	cache := utils.NewFileCache(filepath.Join(t.TempDir(), "cache.db"), false)
+	assert.NoError(t, cache.LoadFile())
+	in := NewServer(utils.ServerCore{Config: utils.ServerConfig{CookieDomain: "a.osintami.com"}, Cache: cache})
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	sync := func(query string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123&"+query, nil)
+		req.Header.Add("User-Agent", CHROME_UA)
+		req.AddCookie(&http.Cookie{Name: MY_COOKIE_ID, Value: "test-my-cookie-id"})
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+	sync("gdpr=1&gdpr_consent=first")
+	sync("gdpr=1&gdpr_consent=first")
+	sync("gdpr=1&gdpr_consent=second")
+	sync("hem=h123")
+
+	consents := in.FindCookie("test-my-cookie-id").Consents
+	assert.Equal(t, 2, len(consents))
+	assert.Equal(t, "first", consents[0].Consent)
+	assert.Equal(t, "second", consents[1].Consent)
+	assert.True(t, consents[1].GDPRApplies)
+}
+
+func TestRecordConsent(t *testing.T) {
+	history := []ConsentRecord{}
+	history = RecordConsent(history, ConsentRecord{PartnerID: "a", Consent: "x"})
+	history = RecordConsent(history, ConsentRecord{PartnerID: "b", Consent: "y"})
+	// unchanged for partner a even though b came in between
+	history = RecordConsent(history, ConsentRecord{PartnerID: "a", Consent: "x"})
+	assert.Equal(t, 2, len(history))
+
+	for i := 0; i < CONSENT_HISTORY+5; i++ {
+		history = RecordConsent(history, ConsentRecord{PartnerID: "a", GDPRApplies: i%2 == 0})
+	}
+	assert.Equal(t, CONSENT_HISTORY, len(history))
+	assert.True(t, history[len(history)-1].GDPRApplies)
+}
+
+func TestExportSubject(t *testing.T) {
+	_, cache, _ := InitEraseServer(t)
+	ci := InitCookieInfo(t)
+	ci.Consents = []ConsentRecord{{PartnerID: ci.PartnerID, GDPRApplies: true, Consent: "tcf"}}
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+
+	export, err := ExportSubject(context.Background(), cache, nil, SUBJECT_HEM, "test-email-hash")
+	assert.NoError(t, err)
+	assert.Equal(t, DSAR_FORMAT, export.Format)
+	assert.Equal(t, 2, len(export.Identities))
+	assert.Equal(t, "same-person-other-browser", export.Identities[0].CookieID)
+	assert.Empty(t, export.Identities[0].ConsentHistory)
+	assert.Equal(t, "test-my-cookie-id", export.Identities[1].CookieID)
+	assert.Equal(t, "tcf", export.Identities[1].ConsentHistory[0].Consent)
+	assert.Nil(t, export.Identities[1].Graph)
+
+	export, err = ExportSubject(context.Background(), cache, nil, SUBJECT_MUID, "never-seen")
+	assert.NoError(t, err)
+	assert.Empty(t, export.Identities)
+
+	_, err = ExportSubject(context.Background(), cache, nil, "", "")
+	assert.ErrorIs(t, err, ErrSubject)
+}
+
+func TestExportIdentityRequests(t *testing.T) {
+	router, _, _ := InitEraseServer(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/admin/identity?muid=test-my-cookie-id", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/admin/identity", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/admin/identity?pcid=other-partner-cookie", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var export DSARExport
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&export))
+	assert.Equal(t, "pcid:other-partner-cookie", export.Subject)
+	assert.Equal(t, 2, len(export.Identities))
+	assert.Equal(t, "other-partner-cookie", export.Identities[0].Cache.PartnerCookieID)
+}
+
+func TestCacheReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	ci := InitCookieInfo(t)
+	cache := utils.NewFileCache(path, true)
+	assert.NoError(t, cache.LoadFile())
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+	assert.NoError(t, cache.Close())
+
+	// a torn record, as left by a server writing while we read
+	journal, err := os.OpenFile(path+utils.JOURNAL_SUFFIX, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = journal.Write([]byte{0, 0, 1})
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Close())
+	before, err := os.Stat(path + utils.JOURNAL_SUFFIX)
+	assert.NoError(t, err)
+
+	reader := utils.NewFileCache(path, true).ReadOnly()
+	assert.NoError(t, reader.LoadFile())
+	_, ok := reader.Get(ci.MyCookieID)
+	assert.True(t, ok)
+	assert.ErrorIs(t, reader.SaveFile(), utils.ErrCacheReadOnly)
+
+	after, err := os.Stat(path + utils.JOURNAL_SUFFIX)
+	assert.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+}
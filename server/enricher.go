@@ -0,0 +1,140 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+
+	"github.com/osintami/monster/utils"
+)
+
+// where an enricher runs
+const (
+	ENRICH_SYNC       = "sync"       // in the request, before the cookie is stored
+	ENRICH_BACKGROUND = "background" // in the graph writer, before the write
+)
+
+var ErrEnricherPanic = errors.New("enricher panic")
+
+// Adds OSINT attributes to a sync, e.g. reputation or breach data for the client address or email hash.
+type Enricher interface {
+	Name() string
+	Enrich(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error)
+}
+
+// Optionally implemented by enrichers whose results can be reused, requests with the same key share a result.
+type CacheableEnricher interface {
+	Enricher
+	CacheKey(ci CookieInfo) string
+}
+
+// Runs enrichers in registration order, each under its own timeout.  A failing, slow or panicking
+// enricher is logged and skipped, it never fails the sync.
+type EnrichPipeline struct {
+	mu      sync.RWMutex
+	stages  map[string][]Enricher
+	timeout time.Duration
+	cache   *cache.Cache
+}
+
+func NewEnrichPipeline(timeout time.Duration, cacheTTL time.Duration) *EnrichPipeline {
+	x := &EnrichPipeline{
+		stages:  map[string][]Enricher{},
+		timeout: timeout}
+	if cacheTTL > 0 {
+		x.cache = cache.New(cacheTTL, 2*cacheTTL)
+	}
+	return x
+}
+
+func (x *EnrichPipeline) Register(mode string, enricher Enricher) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stages[mode] = append(x.stages[mode], enricher)
+}
+
+func (x *EnrichPipeline) Len(mode string) int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.stages[mode])
+}
+
+// Run the enrichers for mode, appending their results to ci so later enrichers can build on earlier ones.
+func (x *EnrichPipeline) Run(ctx context.Context, mode string, ci *CookieInfo) {
+	x.mu.RLock()
+	enrichers := x.stages[mode]
+	x.mu.RUnlock()
+
+	for _, enricher := range enrichers {
+		attrs, err := x.enrich(ctx, enricher, *ci)
+		if err != nil {
+			log.Warn().Err(err).Str("component", "enrich").Str("enricher", enricher.Name()).Str("cookie-id", ci.MyCookieID).Msg("skipped")
+			continue
+		}
+		now := time.Now().UTC()
+		for _, attr := range attrs {
+			ci.Enrichments = append(ci.Enrichments, utils.Enrichment{Enricher: enricher.Name(), At: now, Attribute: attr})
+		}
+	}
+}
+
+func (x *EnrichPipeline) enrich(ctx context.Context, enricher Enricher, ci CookieInfo) ([]utils.Attribute, error) {
+	key := ""
+	if cacheable, ok := enricher.(CacheableEnricher); ok && x.cache != nil {
+		key = enricher.Name() + "|" + cacheable.CacheKey(ci)
+		if attrs, found := x.cache.Get(key); found {
+			return attrs.([]utils.Attribute), nil
+		}
+	}
+
+	attrs, err := x.call(ctx, enricher, ci)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		x.cache.SetDefault(key, attrs)
+	}
+	return attrs, nil
+}
+
+// Call one enricher, giving up at the timeout even when it ignores its context.
+func (x *EnrichPipeline) call(ctx context.Context, enricher Enricher, ci CookieInfo) ([]utils.Attribute, error) {
+	if x.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, x.timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		attrs []utils.Attribute
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("%w: %v", ErrEnricherPanic, r)}
+			}
+		}()
+		attrs, err := enricher.Enrich(ctx, ci)
+		done <- result{attrs: attrs, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.attrs, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Add an enricher to the sync or background stage, call before serving.
+func (x *MonsterServer) RegisterEnricher(mode string, enricher Enricher) {
+	x.enrich.Register(mode, enricher)
+}
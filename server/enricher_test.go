@@ -0,0 +1,99 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEnricher struct {
+	name   string
+	calls  int
+	enrich func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error)
+}
+
+func (x *testEnricher) Name() string { return x.name }
+
+func (x *testEnricher) Enrich(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+	x.calls++
+	return x.enrich(ctx, ci)
+}
+
+type cachedEnricher struct {
+	testEnricher
+}
+
+func (x *cachedEnricher) CacheKey(ci CookieInfo) string { return ci.ClientIP }
+
+func TestEnrichPipelineOrderAndIsolation(t *testing.T) {
+	pipeline := NewEnrichPipeline(20*time.Millisecond, 0)
+	pipeline.Register(ENRICH_SYNC, &testEnricher{name: "first", enrich: func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+		return []utils.Attribute{utils.IntAttr("risk", 70)}, nil
+	}})
+	pipeline.Register(ENRICH_SYNC, &testEnricher{name: "failing", enrich: func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+		return nil, errors.New("upstream down")
+	}})
+	pipeline.Register(ENRICH_SYNC, &testEnricher{name: "panicking", enrich: func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+		panic("boom")
+	}})
+	pipeline.Register(ENRICH_SYNC, &testEnricher{name: "slow", enrich: func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+		time.Sleep(time.Second)
+		return []utils.Attribute{utils.BoolAttr("late", true)}, nil
+	}})
+	// later enrichers see what earlier ones found
+	pipeline.Register(ENRICH_SYNC, &testEnricher{name: "second", enrich: func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+		return []utils.Attribute{utils.BoolAttr("risky", len(ci.Enrichments) == 1 && ci.Enrichments[0].Value == "70")}, nil
+	}})
+
+	ci := InitCookieInfo(t)
+	pipeline.Run(context.Background(), ENRICH_SYNC, &ci)
+
+	assert.Equal(t, 2, len(ci.Enrichments))
+	assert.Equal(t, "first", ci.Enrichments[0].Enricher)
+	assert.Equal(t, utils.ATTR_INT, ci.Enrichments[0].Type)
+	value, err := ci.Enrichments[0].Typed()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(70), value)
+	assert.Equal(t, "second", ci.Enrichments[1].Enricher)
+	assert.Equal(t, "true", ci.Enrichments[1].Value)
+	assert.False(t, ci.Enrichments[1].At.IsZero())
+
+	// nothing registered for the background stage
+	ci = InitCookieInfo(t)
+	pipeline.Run(context.Background(), ENRICH_BACKGROUND, &ci)
+	assert.Empty(t, ci.Enrichments)
+}
+
+func TestEnrichPipelineCache(t *testing.T) {
+	pipeline := NewEnrichPipeline(time.Second, time.Minute)
+	enricher := &cachedEnricher{testEnricher{name: "reputation", enrich: func(ctx context.Context, ci CookieInfo) ([]utils.Attribute, error) {
+		return []utils.Attribute{utils.StringAttr("asn_owner", "ACME")}, nil
+	}}}
+	pipeline.Register(ENRICH_BACKGROUND, enricher)
+
+	for _, ip := range []string{"1.2.3.4", "1.2.3.4", "5.6.7.8"} {
+		ci := InitCookieInfo(t)
+		ci.ClientIP = ip
+		pipeline.Run(context.Background(), ENRICH_BACKGROUND, &ci)
+		assert.Equal(t, "ACME", ci.Enrichments[0].Value)
+	}
+	assert.Equal(t, 2, enricher.calls)
+}
+
+func TestMergeEnrichments(t *testing.T) {
+	browser := utils.Browser{Enrichments: []utils.Enrichment{
+		{Uid: "0x1", Enricher: "reputation", Attribute: utils.IntAttr("risk", 10)}}}
+	browser.MergeEnrichments([]utils.Enrichment{
+		{Enricher: "reputation", Attribute: utils.IntAttr("risk", 90)},
+		{Enricher: "reputation", Attribute: utils.BoolAttr("proxy", true)}})
+
+	assert.Equal(t, 2, len(browser.Enrichments))
+	assert.Equal(t, "0x1", browser.Enrichments[0].Uid)
+	assert.Equal(t, "90", browser.Enrichments[0].Value)
+	assert.Equal(t, "proxy", browser.Enrichments[1].Key)
+}
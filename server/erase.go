@@ -0,0 +1,75 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/osintami/monster/utils"
+)
+
+func (x *MonsterServer) Erase(ctx context.Context, by string, value string) (*utils.ErasureReceipt, error) {
+	return EraseSubject(ctx, x.core.Cache, x.core.Graph, by, value)
+}
+
+// Remove everything held about one person: the cookie subgraph in the store, nodes it leaves orphaned
+// and the cache entries, then rewrite the cache snapshot so the data is gone from disk too.  graph
+// may be nil.
+func EraseSubject(ctx context.Context, cache utils.ICache, graph utils.IdentityStore, by string, value string) (*utils.ErasureReceipt, error) {
+	receipt := &utils.ErasureReceipt{
+		Subject:      by + ":" + value,
+		RequestedAt:  time.Now().UTC(),
+		CookieIDs:    []string{},
+		Nodes:        []utils.ErasedNode{},
+		CacheEntries: []string{}}
+
+	muids, err := ResolveSubject(ctx, cache, graph, by, value)
+	if err != nil {
+		return nil, err
+	}
+	for _, muid := range muids {
+		if graph != nil {
+			nodes, err := graph.EraseCookie(ctx, muid)
+			if err != nil && err != utils.ErrCookieNotFound {
+				return receipt, err
+			}
+			receipt.Nodes = append(receipt.Nodes, nodes...)
+		}
+		if _, ok := cache.Get(muid); ok {
+			cache.Delete(muid)
+			receipt.CacheEntries = append(receipt.CacheEntries, muid)
+		}
+		receipt.CookieIDs = append(receipt.CookieIDs, muid)
+	}
+
+	// the old snapshot and rotated journals still hold the entries until the next save
+	if saver, ok := cache.(interface{ SaveFile() error }); ok && len(receipt.CacheEntries) > 0 {
+		if err := saver.SaveFile(); err != nil {
+			return receipt, err
+		}
+	}
+
+	receipt.CompletedAt = time.Now().UTC()
+	log.Info().Str("component", "erase").Str("by", by).Int("cookies", len(receipt.CookieIDs)).Int("nodes", len(receipt.Nodes)).Msg("erased")
+	return receipt, nil
+}
+
+// DELETE /admin/identity?muid=|pcid=|hem= answers with the deletion receipt.
+func (x *MonsterServer) EraseIdentity(w http.ResponseWriter, r *http.Request) {
+	by, value := subjectParam(r)
+	receipt, err := x.Erase(r.Context(), by, value)
+	if errors.Is(err, ErrSubject) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "erase").Str("by", by).Msg("erase")
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "partial": receipt})
+		return
+	}
+	writeJSON(w, http.StatusOK, receipt)
+}
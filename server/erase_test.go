@@ -0,0 +1,135 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func InitEraseServer(t *testing.T) (*chi.Mux, *utils.FileCache, string) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache := utils.NewFileCache(path, true)
+	assert.NoError(t, cache.LoadFile())
+	t.Cleanup(func() { cache.Close() })
+
+	ci := InitCookieInfo(t)
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+	ci.MyCookieID = "same-person-other-browser"
+	ci.PartnerCookieID = "other-partner-cookie"
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+	ci.MyCookieID = "someone-else"
+	ci.PartnerEmailHash = "other-hash"
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+
+	in := NewServer(utils.ServerCore{Config: utils.ServerConfig{AdminToken: "secret"}, Cache: cache})
+	router := chi.NewMux()
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(in.AdminAuth)
+		r.With(in.RequireCacheLoaded).Get("/identity", in.ExportIdentity)
+		r.With(in.RequireCacheLoaded).Delete("/identity", in.EraseIdentity)
+	})
+	in.CacheLoaded()
+	return router, cache, path
+}
+
+// Until the snapshot has loaded there is nothing to erase or export, and the load would bring it back.
+func TestIdentityRequestsCacheLoading(t *testing.T) {
+	cache := utils.NewFileCache(filepath.Join(t.TempDir(), "cache.db"), false)
+	in := NewServer(utils.ServerCore{Config: utils.ServerConfig{AdminToken: "secret"}, Cache: cache})
+	router := chi.NewMux()
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(in.AdminAuth)
+		r.With(in.RequireCacheLoaded).Get("/identity", in.ExportIdentity)
+		r.With(in.RequireCacheLoaded).Delete("/identity", in.EraseIdentity)
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/admin/identity?muid=test-my-cookie-id", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestEraseByEmailHash(t *testing.T) {
+	router, cache, path := InitEraseServer(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/admin/identity?hem=test-email-hash", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var receipt utils.ErasureReceipt
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&receipt))
+	assert.Equal(t, "hem:test-email-hash", receipt.Subject)
+	assert.Equal(t, []string{"same-person-other-browser", "test-my-cookie-id"}, receipt.CookieIDs)
+	assert.Equal(t, receipt.CookieIDs, receipt.CacheEntries)
+	assert.False(t, receipt.CompletedAt.IsZero())
+
+	_, ok := cache.Get("test-my-cookie-id")
+	assert.False(t, ok)
+	_, ok = cache.Get("someone-else")
+	assert.True(t, ok)
+
+	// gone from disk as well
+	assert.NoError(t, cache.Close())
+	restored := utils.NewFileCache(path, true)
+	assert.NoError(t, restored.LoadFile())
+	defer restored.Close()
+	_, ok = restored.Get("same-person-other-browser")
+	assert.False(t, ok)
+	_, ok = restored.Get("someone-else")
+	assert.True(t, ok)
+}
+
+func TestEraseJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	ci := InitCookieInfo(t)
+	cache := utils.NewFileCache(path, true)
+	assert.NoError(t, cache.LoadFile())
+	cache.Set(ci.MyCookieID, ci, time.Hour)
+	assert.NoError(t, cache.SaveFile())
+	cache.Delete(ci.MyCookieID)
+	assert.NoError(t, cache.Close())
+
+	restored := utils.NewFileCache(path, true)
+	assert.NoError(t, restored.LoadFile())
+	defer restored.Close()
+	_, ok := restored.Get(ci.MyCookieID)
+	assert.False(t, ok)
+}
+
+func TestEraseIdentityRequests(t *testing.T) {
+	router, _, _ := InitEraseServer(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/admin/identity?muid=test-my-cookie-id", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/admin/identity", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/admin/identity?pcid=other-partner-cookie", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var receipt utils.ErasureReceipt
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&receipt))
+	assert.Equal(t, []string{"same-person-other-browser", "someone-else"}, receipt.CookieIDs)
+}
@@ -0,0 +1,184 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// one IPv4 prefix per record, enough of the MaxMind DB format for a test fixture
+type mmdbEntry struct {
+	prefix string
+	record map[string]interface{}
+}
+
+func mmdbValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if len(v) < 29 {
+			buf.WriteByte(0x40 | byte(len(v)))
+		} else {
+			buf.Write([]byte{0x40 | 29, byte(len(v) - 29)})
+		}
+		buf.WriteString(v)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		buf.WriteByte(0xC0 | 4)
+		buf.Write(b)
+	case uint16:
+		buf.WriteByte(0xA0 | 2)
+		buf.Write([]byte{byte(v >> 8), byte(v)})
+	case uint64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		buf.WriteByte(8)
+		buf.WriteByte(2)
+		buf.Write(b)
+	case []interface{}:
+		buf.WriteByte(byte(len(v)))
+		buf.WriteByte(4)
+		for _, item := range v {
+			mmdbValue(buf, item)
+		}
+	case map[string]interface{}:
+		buf.WriteByte(0xE0 | byte(len(v)))
+		for key, item := range v {
+			mmdbValue(buf, key)
+			mmdbValue(buf, item)
+		}
+	}
+}
+
+func WriteTestMMDB(t *testing.T, path string, dbType string, entries []mmdbEntry) {
+	type node struct{ left, right int }
+	nodes := []node{{-1, -1}}
+	data := bytes.Buffer{}
+	// leaves hold -2-offset until the node count is known
+	for _, entry := range entries {
+		_, prefix, err := net.ParseCIDR(entry.prefix)
+		assert.Nil(t, err)
+		ones, _ := prefix.Mask.Size()
+		ip := prefix.IP.To4()
+
+		offset := data.Len()
+		mmdbValue(&data, entry.record)
+
+		current := 0
+		for bit := 0; bit < ones; bit++ {
+			right := ip[bit/8]&(0x80>>(bit%8)) != 0
+			last := bit == ones-1
+			next := &nodes[current].left
+			if right {
+				next = &nodes[current].right
+			}
+			if last {
+				*next = -2 - offset
+				break
+			}
+			if *next < 0 {
+				nodes = append(nodes, node{-1, -1})
+				*next = len(nodes) - 1
+				if right {
+					nodes[current].right = *next
+				} else {
+					nodes[current].left = *next
+				}
+			}
+			current = *next
+		}
+	}
+
+	count := len(nodes)
+	resolve := func(v int) int {
+		switch {
+		case v == -1:
+			return count
+		case v <= -2:
+			return count + 16 + (-2 - v)
+		}
+		return v
+	}
+	out := bytes.Buffer{}
+	for _, n := range nodes {
+		for _, v := range []int{resolve(n.left), resolve(n.right)} {
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	mmdbValue(&out, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               dbType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"description":                 map[string]interface{}{"en": "test"}})
+	assert.Nil(t, os.WriteFile(path, out.Bytes(), 0644))
+}
+
+func cityRecord(country, region, city string) map[string]interface{} {
+	return map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": country},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": region}},
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": city}}}
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	dir := t.TempDir()
+	city := filepath.Join(dir, "city.mmdb")
+	asn := filepath.Join(dir, "asn.mmdb")
+	WriteTestMMDB(t, city, "GeoLite2-City", []mmdbEntry{
+		{"8.8.8.0/24", cityRecord("US", "CA", "Mountain View")}})
+	WriteTestMMDB(t, asn, "GeoLite2-ASN", []mmdbEntry{
+		{"8.8.0.0/16", map[string]interface{}{
+			"autonomous_system_number":       uint32(15169),
+			"autonomous_system_organization": "GOOGLE"}}})
+
+	geoip := utils.NewGeoIP([]string{city, asn, filepath.Join(dir, "missing.mmdb")})
+	defer geoip.Close()
+
+	geo, ok := geoip.Lookup("8.8.8.8, 10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, utils.Geo{Country: "US", Region: "CA", City: "Mountain View", ASN: 15169, Org: "GOOGLE"}, geo)
+
+	geo, ok = geoip.Lookup("8.8.4.4")
+	assert.True(t, ok)
+	assert.Equal(t, utils.Geo{ASN: 15169, Org: "GOOGLE"}, geo)
+
+	_, ok = geoip.Lookup("1.1.1.1")
+	assert.False(t, ok)
+	_, ok = geoip.Lookup("garbage")
+	assert.False(t, ok)
+}
+
+func TestGeoIPReload(t *testing.T) {
+	city := filepath.Join(t.TempDir(), "city.mmdb")
+	WriteTestMMDB(t, city, "GeoLite2-City", []mmdbEntry{
+		{"8.8.8.0/24", cityRecord("US", "CA", "Mountain View")}})
+	geoip := utils.NewGeoIP([]string{city})
+	defer geoip.Close()
+
+	WriteTestMMDB(t, city, "GeoLite2-City", []mmdbEntry{
+		{"8.8.8.0/24", cityRecord("US", "NY", "New York")}})
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(city, later, later))
+	geoip.Reload()
+
+	geo, ok := geoip.Lookup("8.8.8.8")
+	assert.True(t, ok)
+	assert.Equal(t, "New York", geo.City)
+	assert.Equal(t, "NY", geo.Region)
+}
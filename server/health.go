@@ -0,0 +1,101 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	STATUS_OK      = "ok"
+	STATUS_FAIL    = "fail"
+	STATUS_PENDING = "pending"
+	CHECK_CACHE    = "cache"
+	HEALTH_SERVICE = "monster"
+	READY_TIMEOUT  = 2 * time.Second
+)
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthStatus struct {
+	Service string                 `json:"service"`
+	Status  string                 `json:"status"`
+	Checks  map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// Liveness, the process is up and serving HTTP.
+func (x *MonsterServer) Healthz(w http.ResponseWriter, r *http.Request) {
+	x.writeHealth(w, http.StatusOK, HealthStatus{Service: HEALTH_SERVICE, Status: STATUS_OK})
+}
+
+// Readiness, the cache has been loaded from disk and the identity store answers, its check is named
+// for the IDENTITY_STORE backend.
+func (x *MonsterServer) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), READY_TIMEOUT)
+	defer cancel()
+
+	status := HealthStatus{
+		Service: HEALTH_SERVICE,
+		Status:  STATUS_OK,
+		Checks:  make(map[string]HealthCheck)}
+
+	if x.IsCacheLoaded() {
+		status.Checks[CHECK_CACHE] = HealthCheck{Status: STATUS_OK}
+	} else {
+		status.Checks[CHECK_CACHE] = HealthCheck{Status: STATUS_PENDING}
+		status.Status = STATUS_FAIL
+	}
+
+	if x.core.Graph != nil {
+		check := x.core.Config.IdentityStore
+		if err := x.core.Graph.Ping(ctx); err != nil {
+			status.Checks[check] = HealthCheck{Status: STATUS_FAIL, Error: err.Error()}
+			status.Status = STATUS_FAIL
+		} else {
+			status.Checks[check] = HealthCheck{Status: STATUS_OK}
+		}
+	}
+
+	code := http.StatusOK
+	if status.Status != STATUS_OK {
+		code = http.StatusServiceUnavailable
+	}
+	x.writeHealth(w, code, status)
+}
+
+// Flag the cache as loaded, called once LoadFile has returned.
+func (x *MonsterServer) CacheLoaded() {
+	x.cacheLoaded.Store(true)
+}
+
+func (x *MonsterServer) IsCacheLoaded() bool {
+	return x.cacheLoaded.Load()
+}
+
+// Turn syncs and identity requests away with a 503 until the cache has loaded, replaying the
+// snapshot would overwrite their writes and the journal is not open yet.
+func (x *MonsterServer) RequireCacheLoaded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !x.IsCacheLoaded() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (x *MonsterServer) writeHealth(w http.ResponseWriter, code int, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Warn().Err(err).Str("component", "health").Msg("encode")
+	}
+}
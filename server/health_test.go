@@ -0,0 +1,133 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthz(t *testing.T) {
+	router, _ := InitHealthServer(t, "", nil)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	status := decodeHealth(t, w)
+	assert.Equal(t, STATUS_OK, status.Status)
+	assert.Empty(t, status.Checks)
+}
+
+func TestReadyzCachePending(t *testing.T) {
+	router, _ := InitHealthServer(t, "", nil)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	status := decodeHealth(t, w)
+	assert.Equal(t, STATUS_FAIL, status.Status)
+	assert.Equal(t, STATUS_PENDING, status.Checks[CHECK_CACHE].Status)
+}
+
+func TestReadyzCacheLoaded(t *testing.T) {
+	router, in := InitHealthServer(t, "", nil)
+	in.CacheLoaded()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	status := decodeHealth(t, w)
+	assert.Equal(t, STATUS_OK, status.Status)
+	assert.Equal(t, STATUS_OK, status.Checks[CHECK_CACHE].Status)
+}
+
+func TestCookieSyncCacheLoading(t *testing.T) {
+	router, in := InitHealthServer(t, "", nil)
+	synced := 0
+	router.With(in.RequireCacheLoaded).Get("/csr", func(w http.ResponseWriter, r *http.Request) {
+		synced++
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pid=pdq123&pcid=xyz456", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, 0, synced)
+
+	in.CacheLoaded()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 1, synced)
+}
+
+func TestReadyzDgraphDown(t *testing.T) {
+	// nothing listens on port 1, the ping fails fast
+	graph, err := utils.NewDgraph(utils.ServerConfig{DgraphSvrs: []string{"127.0.0.1:1"}})
+	assert.NoError(t, err)
+	defer graph.Close()
+	router, in := InitHealthServer(t, utils.STORE_DGRAPH, utils.NewDgraphStore(graph))
+	in.CacheLoaded()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	status := decodeHealth(t, w)
+	assert.Equal(t, STATUS_FAIL, status.Status)
+	assert.Equal(t, STATUS_OK, status.Checks[CHECK_CACHE].Status)
+	assert.Equal(t, STATUS_FAIL, status.Checks[utils.STORE_DGRAPH].Status)
+	assert.NotEmpty(t, status.Checks[utils.STORE_DGRAPH].Error)
+}
+
+func TestReadyzSQL(t *testing.T) {
+	store, err := utils.NewSQLStore(utils.SQL_SQLITE, filepath.Join(t.TempDir(), "identity.db"), 2)
+	assert.NoError(t, err)
+	defer store.Close()
+	router, in := InitHealthServer(t, utils.STORE_SQL, store)
+	in.CacheLoaded()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	status := decodeHealth(t, w)
+	assert.Equal(t, STATUS_OK, status.Checks[utils.STORE_SQL].Status)
+	assert.NotContains(t, status.Checks, utils.STORE_DGRAPH)
+}
+
+func InitHealthServer(t *testing.T, backend string, graph utils.IdentityStore) (*chi.Mux, *MonsterServer) {
+	core := utils.ServerCore{
+		Config: utils.ServerConfig{IdentityStore: backend},
+		Cache:  NewMockCache(t),
+		Graph:  graph,
+	}
+	in := NewServer(core)
+
+	router := chi.NewMux()
+	router.Get("/healthz", in.Healthz)
+	router.Get("/readyz", in.Readyz)
+	return router, in
+}
+
+func decodeHealth(t *testing.T, w *httptest.ResponseRecorder) HealthStatus {
+	var status HealthStatus
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	assert.NoError(t, err)
+	return status
+}
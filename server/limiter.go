@@ -0,0 +1,141 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+const (
+	LIMIT_BY_IP      = "ip"
+	LIMIT_BY_PARTNER = "pid"
+	LIMIT_IDLE_TTL    = 10 * time.Minute
+	LIMIT_MAX_BUCKETS = 100000
+)
+
+type PartnerLimit struct {
+	PerSecond float64 `json:"rps"`
+	Burst     int     `json:"burst"`
+}
+
+type bucket struct {
+	key     string
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// Token buckets keyed by client IP and by partner id, idle buckets are evicted after LIMIT_IDLE_TTL.
+// At most max buckets are held, a new key beyond that pushes out the least recently seen one so a
+// flood of new addresses costs the quietest clients a fresh burst rather than locking everyone out.
+type RateLimiter struct {
+	mu        sync.Mutex
+	ip        PartnerLimit
+	partner   PartnerLimit
+	overrides map[string]PartnerLimit
+	buckets   map[string]*list.Element
+	recent    *list.List // most recently seen first
+	max       int
+	swept     time.Time
+}
+
+func NewRateLimiter(ip, partner PartnerLimit, overrides map[string]PartnerLimit, max int) *RateLimiter {
+	if overrides == nil {
+		overrides = make(map[string]PartnerLimit)
+	}
+	if max <= 0 {
+		max = LIMIT_MAX_BUCKETS
+	}
+	return &RateLimiter{
+		ip:        ip,
+		partner:   partner,
+		overrides: overrides,
+		buckets:   make(map[string]*list.Element),
+		recent:    list.New(),
+		max:       max,
+		swept:     time.Now()}
+}
+
+// Per partner limits, a JSON object of pid to {"rps": n, "burst": n}.  A missing file means no overrides.
+func LoadPartnerLimits(path string) (map[string]PartnerLimit, error) {
+	limits := make(map[string]PartnerLimit)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return limits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &limits); err != nil {
+		log.Error().Err(err).Str("component", "limiter").Str("path", path).Msg("unmarshal")
+		return nil, err
+	}
+	return limits, nil
+}
+
+// Spend one token from both the IP and partner buckets, returns the limit that refused the request.
+func (x *RateLimiter) Allow(ip, pid string) (bool, string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(x.swept) > LIMIT_IDLE_TTL {
+		x.sweep(now)
+	}
+
+	if ip != "" && x.ip.PerSecond > 0 {
+		if !x.take(LIMIT_BY_IP+":"+ip, x.ip, now) {
+			return false, LIMIT_BY_IP
+		}
+	}
+
+	// every partner has its own bucket, the partner rate is the default for those without an override
+	limit, ok := x.overrides[pid]
+	if !ok {
+		limit = x.partner
+	}
+	if pid != "" && limit.PerSecond > 0 {
+		if !x.take(LIMIT_BY_PARTNER+":"+pid, limit, now) {
+			return false, LIMIT_BY_PARTNER
+		}
+	}
+	return true, ""
+}
+
+func (x *RateLimiter) take(key string, limit PartnerLimit, now time.Time) bool {
+	if e, ok := x.buckets[key]; ok {
+		b := e.Value.(*bucket)
+		b.seen = now
+		x.recent.MoveToFront(e)
+		return b.limiter.AllowN(now, 1)
+	}
+	if len(x.buckets) >= x.max {
+		x.evict(x.recent.Back())
+		log.Debug().Str("component", "limiter").Int("buckets", len(x.buckets)).Msg("bucket limit reached, evicted oldest")
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	b := &bucket{key: key, limiter: rate.NewLimiter(rate.Limit(limit.PerSecond), burst), seen: now}
+	x.buckets[key] = x.recent.PushFront(b)
+	return b.limiter.AllowN(now, 1)
+}
+
+// The least recently seen buckets are at the back, stop at the first one still in use.
+func (x *RateLimiter) sweep(now time.Time) {
+	for e := x.recent.Back(); e != nil && now.Sub(e.Value.(*bucket).seen) > LIMIT_IDLE_TTL; e = x.recent.Back() {
+		x.evict(e)
+	}
+	x.swept = now
+}
+
+func (x *RateLimiter) evict(e *list.Element) {
+	x.recent.Remove(e)
+	delete(x.buckets, e.Value.(*bucket).key)
+}
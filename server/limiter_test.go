@@ -0,0 +1,135 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRateLimiterByIP(t *testing.T) {
+	limiter := NewRateLimiter(PartnerLimit{PerSecond: 1, Burst: 2}, PartnerLimit{}, nil, 0)
+
+	ok, _ := limiter.Allow("220.120.12.13", "pdq123")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("220.120.12.13", "pdq123")
+	assert.True(t, ok)
+	ok, by := limiter.Allow("220.120.12.13", "pdq123")
+	assert.False(t, ok)
+	assert.Equal(t, LIMIT_BY_IP, by)
+
+	// other clients have their own bucket
+	ok, _ = limiter.Allow("220.120.12.14", "pdq123")
+	assert.True(t, ok)
+}
+
+func TestRateLimiterPartnerOverride(t *testing.T) {
+	overrides := map[string]PartnerLimit{"big": {PerSecond: 100, Burst: 3}}
+	limiter := NewRateLimiter(PartnerLimit{}, PartnerLimit{PerSecond: 1, Burst: 1}, overrides, 0)
+
+	ok, _ := limiter.Allow("1.1.1.1", "small")
+	assert.True(t, ok)
+	ok, by := limiter.Allow("1.1.1.2", "small")
+	assert.False(t, ok)
+	assert.Equal(t, LIMIT_BY_PARTNER, by)
+
+	for i := 0; i < 3; i++ {
+		ok, _ = limiter.Allow(fmt.Sprintf("1.1.1.%d", i), "big")
+		assert.True(t, ok)
+	}
+	ok, _ = limiter.Allow("1.1.1.9", "big")
+	assert.False(t, ok)
+}
+
+func TestRateLimiterPartnerBuckets(t *testing.T) {
+	limiter := NewRateLimiter(PartnerLimit{}, PartnerLimit{PerSecond: 1, Burst: 1}, nil, 0)
+
+	// a noisy partner spends its own tokens, not those of the partners beside it
+	ok, _ := limiter.Allow("", "noisy")
+	assert.True(t, ok)
+	ok, by := limiter.Allow("", "noisy")
+	assert.False(t, ok)
+	assert.Equal(t, LIMIT_BY_PARTNER, by)
+	ok, _ = limiter.Allow("", "quiet")
+	assert.True(t, ok)
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	limiter := NewRateLimiter(PartnerLimit{PerSecond: 1, Burst: 1}, PartnerLimit{}, nil, 3)
+
+	// three clients fill the map
+	for _, ip := range []string{"1.1.1.1", "1.1.1.2", "1.1.1.3"} {
+		ok, _ := limiter.Allow(ip, "")
+		assert.True(t, ok)
+	}
+	ok, _ := limiter.Allow("1.1.1.2", "")
+	assert.False(t, ok)
+
+	// a client never seen before still gets through, the least recently seen one makes room
+	ok, _ = limiter.Allow("1.1.1.4", "")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("1.1.1.1", "")
+	assert.True(t, ok)
+	// the client seen since keeps its spent bucket
+	ok, by := limiter.Allow("1.1.1.2", "")
+	assert.False(t, ok)
+	assert.Equal(t, LIMIT_BY_IP, by)
+}
+
+func TestRateLimitStatus(t *testing.T) {
+	cfg := utils.ServerConfig{RateLimitStatus: http.StatusTooManyRequests}
+	assert.NoError(t, cfg.Validate())
+	cfg.RateLimitStatus = http.StatusNoContent
+	assert.NoError(t, cfg.Validate())
+	cfg.RateLimitStatus = 0
+	assert.Equal(t, utils.ErrRateLimitStatus, cfg.Validate())
+}
+
+func TestLoadPartnerLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partner_limits.json")
+
+	limits, err := LoadPartnerLimits(path)
+	assert.NoError(t, err)
+	assert.Empty(t, limits)
+
+	os.WriteFile(path, []byte(`{"pdq123": {"rps": 50, "burst": 10}}`), 0600)
+	limits, err = LoadPartnerLimits(path)
+	assert.NoError(t, err)
+	assert.Equal(t, PartnerLimit{PerSecond: 50, Burst: 10}, limits["pdq123"])
+}
+
+func TestCookieSyncRateLimited(t *testing.T) {
+	cache := NewMockCache(t)
+	cfg := utils.ServerConfig{
+		CookieDomain:    "a.osintami.com",
+		FSPath:          t.TempDir() + "/",
+		RateIPPerSecond: 1,
+		RateIPBurst:     1,
+		RateLimitStatus: http.StatusTooManyRequests}
+	cache.On("Get", mock.Anything).Return(InitCookieInfo(t), true).Once()
+	in := NewServer(utils.ServerCore{Config: cfg, Cache: cache})
+
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123", nil)
+		req.RemoteAddr = "220.120.12.13:40000"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, send().Code)
+	w := send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Empty(t, w.Result().Header["Set-Cookie"])
+}
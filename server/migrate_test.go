@@ -0,0 +1,18 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"testing"
+
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range utils.Migrations {
+		assert.Equal(t, i+1, m.Version, m.Name)
+		assert.NotEmpty(t, m.Name)
+		assert.True(t, m.Schema != "" || m.Backfill != nil, m.Name)
+	}
+	assert.Equal(t, len(utils.Migrations), utils.LatestVersion(utils.Migrations))
+}
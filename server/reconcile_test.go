@@ -0,0 +1,139 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func readAudit(t *testing.T, path string) []utils.ReconcileRecord {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	records := []utils.ReconcileRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record utils.ReconcileRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+// Only a race between writers, or sql tables from before the unique cookie index, leave a cookie
+// id on two nodes.  Drop the index and write the second one by hand.
+func TestReconcileDuplicates(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := utils.NewSQLStore(utils.SQL_SQLITE, filepath.Join(dir, "identity.db"), 2)
+	assert.NoError(t, err)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "identity.db")), &gorm.Config{})
+	assert.NoError(t, err)
+
+	shared := utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"}
+	originals := make(map[string]string)
+	for _, cookieID := range []string{"xyz123", "abc789", "def456"} {
+		cookie, err := store.LinkCookie(ctx, cookieID, shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, []string{"a"})
+		assert.NoError(t, err)
+		originals[cookieID] = cookie.Uid
+	}
+	assert.NoError(t, db.Exec(`DROP INDEX idx_cookie_unique`).Error)
+	duplicate := func(cookieID string, issued time.Time) {
+		cookie, err := store.FindCookie(ctx, cookieID)
+		assert.NoError(t, err)
+		browser := strings.TrimPrefix(cookie.Browsers[0].Uid, "browser:")
+		assert.NoError(t, db.Exec(`INSERT INTO cookies (cookie, issued, tags) VALUES (?, ?, '["b"]')`, cookieID, issued).Error)
+		assert.NoError(t, db.Exec(`INSERT INTO links (cookie_ref, kind, node_ref, link_key, hits, source)
+			VALUES ((SELECT MAX(id) FROM cookies), 'browser', ?, ?, 3, 'abc999')`, browser, cookie.Browsers[0].Uid).Error)
+	}
+	issued := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	duplicate("xyz123", issued)
+	duplicate("abc789", issued)
+
+	ids, err := store.FindDuplicateCookieIDs(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"xyz123", "abc789"}, ids)
+	_, err = store.FindCookie(ctx, "xyz123")
+	assert.Equal(t, utils.ErrDuplicateCookiesExist, err)
+
+	audit := filepath.Join(dir, "reconcile_audit.jsonl")
+	reconciler := utils.NewReconciler(store, audit, 0)
+
+	// inline, the lookup answers with the merged node, the duplicate was issued first so it stays
+	cookie, err := reconciler.FindCookie(ctx, "xyz123")
+	assert.NoError(t, err)
+	assert.NotEqual(t, originals["xyz123"], cookie.Uid)
+	assert.ElementsMatch(t, []string{"a", "b"}, cookie.Tags)
+	assert.Equal(t, 1, len(cookie.Browsers))
+	assert.Equal(t, 4, cookie.Browsers[0].Hits)
+	assert.Equal(t, 1, len(cookie.Partners))
+	assert.True(t, issued.Equal(*cookie.IssuedAt))
+
+	// background, the rest, an audit file that cannot be written loses the line and not the merge
+	broken := utils.NewReconciler(store, filepath.Join(dir, "missing", "reconcile_audit.jsonl"), 0)
+	records, err := broken.Sweep(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "abc789", records[0].CookieID)
+	assert.Equal(t, records[0].Canonical, records[0].Cookie.Uid)
+	assert.Equal(t, 4, records[0].Cookie.Browsers[0].Hits)
+	ids, err = store.FindDuplicateCookieIDs(ctx, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	logged := readAudit(t, audit)
+	assert.Equal(t, 1, len(logged))
+	assert.Equal(t, "xyz123", logged[0].CookieID)
+	assert.True(t, logged[0].Inline)
+	assert.Equal(t, []string{originals["xyz123"]}, logged[0].Merged)
+	assert.Equal(t, cookie.Uid, logged[0].Canonical)
+
+	// nothing left to do
+	record, err := store.ReconcileCookie(ctx, "xyz123")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+	_, err = store.ReconcileCookie(ctx, "missing")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+
+	// opening old tables merges what is left and puts the index back
+	duplicate("def456", issued)
+	assert.NoError(t, store.Close())
+	store, err = utils.NewSQLStore(utils.SQL_SQLITE, filepath.Join(dir, "identity.db"), 2)
+	assert.NoError(t, err)
+	defer store.Close()
+	ids, err = store.FindDuplicateCookieIDs(ctx, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	cookie, err = store.FindCookie(ctx, "def456")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, cookie.Tags)
+	assert.Error(t, db.Exec(`INSERT INTO cookies (cookie) VALUES ('def456')`).Error)
+}
+
+func TestReconcileDgraph(t *testing.T) {
+	dg, ctx := InitDgraph(t)
+	store := utils.NewDgraphStore(dg)
+	for i := 0; i < 2; i++ {
+		_, err := dg.CreateCookie(ctx, nil, &utils.Cookie{Uid: "_:cookie", CookieID: "xyz123", Tags: []string{string(rune('a' + i))}}, true)
+		assert.NoError(t, err)
+	}
+	ids, err := store.FindDuplicateCookieIDs(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"xyz123"}, ids)
+
+	reconciler := utils.NewReconciler(store, "", 0)
+	cookie, err := reconciler.FindCookie(ctx, "xyz123")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, cookie.Tags)
+}
@@ -0,0 +1,120 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/engine"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_RULES = `{"rules": [
+	{"name": "eu-no-consent", "match": {"countries": ["DE", "FR"], "gdpr": true, "consent": false}, "action": {"sync": "deny"}, "stop": true},
+	{"name": "no-hem-for-new", "match": {"partners": ["pdq123"], "max_cookie_age": "24h"}, "action": {"suppress_macros": ["EHASH_SHA256_LOWERCASE"], "tags": ["fresh"]}},
+	{"name": "datacenter", "match": {"traffic": ["datacenter"]}, "action": {"redirect": "/dc", "tags": ["dc"]}},
+	{"name": "mobile", "match": {"device_types": ["mobile"], "min_cookie_age": "720h"}, "action": {"sync": "allow", "tags": ["loyal"]}}
+]}`
+
+func writeRules(t *testing.T, path string, rules string) {
+	assert.Nil(t, os.WriteFile(path, []byte(rules), 0644))
+}
+
+func TestRulesEvaluate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, TEST_RULES)
+	rules := engine.NewRulesEngine(path)
+	assert.Equal(t, 4, rules.Len())
+
+	decision := rules.Evaluate(engine.Facts{Country: "de", GDPRApplies: true, PartnerID: "pdq123"})
+	assert.True(t, decision.Denied())
+	assert.Equal(t, []string{"eu-no-consent"}, decision.Matched)
+
+	decision = rules.Evaluate(engine.Facts{Country: "DE", GDPRApplies: true, Consent: true, PartnerID: "pdq123", Traffic: TRAFFIC_DATACENTER, CookieAge: time.Hour})
+	assert.False(t, decision.Denied())
+	assert.Equal(t, "/dc", decision.Redirect)
+	assert.Equal(t, []string{"EHASH_SHA256_LOWERCASE"}, decision.SuppressMacros)
+	assert.Equal(t, []string{"fresh", "dc"}, decision.Tags)
+
+	decision = rules.Evaluate(engine.Facts{DeviceType: utils.DEVICE_MOBILE, CookieAge: 1000 * time.Hour, Consent: true})
+	assert.Equal(t, engine.SYNC_ALLOW, decision.Sync)
+	assert.Equal(t, []string{"mobile"}, decision.Matched)
+}
+
+func TestRulesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := engine.NewRulesEngine(path)
+	assert.Equal(t, 0, rules.Len())
+	assert.False(t, rules.Evaluate(engine.Facts{}).Denied())
+
+	writeRules(t, path, `{"rules": [{"name": "all", "action": {"sync": "deny"}}]}`)
+	assert.Nil(t, rules.Reload())
+	assert.True(t, rules.Evaluate(engine.Facts{}).Denied())
+	loaded := rules.LoadedAt()
+	assert.False(t, loaded.IsZero())
+
+	// a bad edit keeps the last good policy
+	writeRules(t, path, `{"rules": [{"name": "typo", "action": {"sync": "maybe"}}]}`)
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	assert.ErrorIs(t, rules.Reload(), engine.ErrInvalidRule)
+	assert.True(t, rules.Evaluate(engine.Facts{}).Denied())
+	assert.Equal(t, loaded, rules.LoadedAt())
+
+	// removing the file removes the policy, as a missing file does at startup
+	assert.Nil(t, os.Remove(path))
+	assert.True(t, os.IsNotExist(rules.Reload()))
+	assert.Equal(t, 0, rules.Len())
+	assert.False(t, rules.Evaluate(engine.Facts{}).Denied())
+	assert.True(t, rules.LoadedAt().IsZero())
+}
+
+func TestCookieSyncRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, TEST_RULES)
+	in := NewServer(utils.ServerCore{
+		Config: utils.ServerConfig{CookieDomain: "a.osintami.com"},
+		Cache:  NewMockCache(t),
+		Rules:  engine.NewRulesEngine(path)})
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	next := url.QueryEscape("https://partner.com/?uid=${DEVICE_ID}&hem=${EHASH_SHA256_LOWERCASE}")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123&hem=h123&r="+next, nil)
+	req.Header.Add("User-Agent", CHROME_UA)
+	req.RemoteAddr = "220.120.12.13:40000"
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Result().Header.Get("Location"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, location.Query().Get("uid"))
+	assert.Equal(t, "", location.Query().Get("hem"))
+}
+
+func TestCookieSyncRulesDeny(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, `{"rules": [{"name": "no-consent", "match": {"gdpr": true, "consent": false}, "action": {"sync": "deny"}}]}`)
+	in := NewServer(utils.ServerCore{
+		Config: utils.ServerConfig{CookieDomain: "a.osintami.com"},
+		Cache:  NewMockCache(t),
+		Rules:  engine.NewRulesEngine(path)})
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123&hem=h123&gdpr=1&r=/next", nil)
+	req.Header.Add("User-Agent", CHROME_UA)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Result().Header["Set-Cookie"])
+}
@@ -0,0 +1,31 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"testing"
+
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaMatchesStructs(t *testing.T) {
+	assert.Empty(t, utils.CompareSchema(utils.StructSchema(), utils.MigratedSchema(utils.Migrations)))
+}
+
+func TestCompareSchema(t *testing.T) {
+	// the baseline schema declared the edges capitalised while the structs marshal them lowercase
+	baseline := utils.MigratedSchema(utils.Migrations[:1])
+	problems := utils.CompareSchema(utils.StructSchema(), baseline)
+	assert.Contains(t, problems, "predicate browser missing, want [uid]")
+	assert.Contains(t, problems, "type Cookie lacks partner")
+
+	live := utils.ParseSchema(`
+		cookie: int .
+		type Cookie {
+			cookie
+		}
+	`)
+	problems = utils.CompareSchema(utils.StructSchema(), live)
+	assert.Contains(t, problems, "predicate cookie is int, want string")
+	assert.Contains(t, problems, "type Browser missing")
+}
@@ -2,22 +2,36 @@
 package server
 
 import (
+	"context"
+	"encoding/gob"
 	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
 
+	"github.com/osintami/monster/engine"
 	"github.com/osintami/monster/utils"
 )
 
 type MonsterServer struct {
-	core    utils.ServerCore
-	uaregex *regexp.Regexp
+	core        utils.ServerCore
+	uaregex     *regexp.Regexp
+	cacheLoaded atomic.Bool
+	writer      *GraphWriter
+	limiter     *RateLimiter
+	traffic     *TrafficClassifier
+	anonymizer  *AnonymizerSet
+	geo         *utils.GeoIP
+	enrich      *EnrichPipeline
+	proxies     *netaddr.IPSet
 }
 
 const (
@@ -27,20 +41,91 @@ const (
 
 var ErrEHashNotFound = errors.New("ehash not found")
 
+func init() {
+	// cache snapshots and journals are gob encoded
+	gob.Register(CookieInfo{})
+}
+
 func NewServer(core utils.ServerCore) *MonsterServer {
-	return &MonsterServer{
+	x := &MonsterServer{
 		core:    core,
-		uaregex: regexp.MustCompile(`useragent=([^&#]*)`)}
+		uaregex: regexp.MustCompile(`useragent=([^&#]*)`),
+		enrich:  NewEnrichPipeline(core.Config.EnrichTimeout, core.Config.EnrichCacheTTL),
+		proxies: TrustedProxies(core.Config.TrustedProxies)}
+	if core.Graph != nil && core.Config.GraphSync {
+		x.writer = NewGraphWriter(x.writeGraph, core.Config.GraphQueueSize)
+		x.writer.Start()
+	}
+	if core.Config.RateIPPerSecond > 0 && len(core.Config.TrustedProxies) == 0 {
+		log.Warn().Str("component", "limiter").Msg("RATE_IP_RPS is on without TRUSTED_PROXIES, behind a load balancer every client shares one bucket")
+	}
+	if core.Config.RateIPPerSecond > 0 || core.Config.RatePartnerPerSecond > 0 {
+		overrides, err := LoadPartnerLimits(core.Config.FSPath + core.Config.RatePartnerFile)
+		if err != nil {
+			log.Warn().Err(err).Str("component", "limiter").Msg("partner limits ignored")
+		}
+		x.limiter = NewRateLimiter(
+			PartnerLimit{PerSecond: core.Config.RateIPPerSecond, Burst: core.Config.RateIPBurst},
+			PartnerLimit{PerSecond: core.Config.RatePartnerPerSecond, Burst: core.Config.RatePartnerBurst},
+			overrides,
+			core.Config.RateMaxBuckets)
+	}
+	if core.Config.TrafficFilter {
+		traffic, err := LoadTrafficClassifier(
+			core.Config.FSPath+core.Config.BotSignatureFile,
+			prefixPaths(core.Config.FSPath, core.Config.DatacenterFiles),
+			core.Config.BotAction,
+			core.Config.DatacenterAction)
+		if err != nil {
+			log.Error().Err(err).Str("component", "traffic").Msg("classifier disabled")
+		}
+		x.traffic = traffic
+	}
+	if core.Config.AnonymizerFilter {
+		anonymizer, err := NewAnonymizerSet(
+			prefixPaths(core.Config.FSPath, core.Config.TorExitFiles),
+			prefixPaths(core.Config.FSPath, core.Config.VPNFiles))
+		if err != nil {
+			log.Error().Err(err).Str("component", "anonymizer").Msg("classifier disabled")
+		} else {
+			anonymizer.Watch(core.Config.AnonymizerReload)
+			x.anonymizer = anonymizer
+		}
+	}
+	if len(core.Config.GeoIPFiles) > 0 {
+		x.geo = utils.NewGeoIP(prefixPaths(core.Config.FSPath, core.Config.GeoIPFiles))
+		x.geo.Watch(core.Config.GeoIPReload)
+	}
+	return x
+}
+
+func prefixPaths(prefix string, files []string) []string {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, prefix+file)
+	}
+	return paths
 }
 
 type CookieInfo struct {
-	MyCookieID       string // found in cookies
-	PartnerCookieID  string // query param
-	PartnerID        string // query param
-	PartnerEmailHash string // query param
-	RedirectURL      string // query param
-	UserAgent        string // found in header
-	ClientIP         string // found in header
+	MyCookieID       string             // found in cookies
+	PartnerCookieID  string             // query param
+	PartnerID        string             // query param
+	PartnerEmailHash string             // query param
+	RedirectURL      string             // query param
+	UserAgent        string             // found in header
+	ClientIP         string             // found in header
+	Traffic          string             // non-human class when tagged, empty for humans
+	Anonymizer       string             // tor or vpn when the client address is a known anonymizer
+	ClientHints      utils.ClientHints  // found in Sec-CH-UA-* headers
+	Geo              utils.Geo          // looked up from ClientIP
+	Enrichments      []utils.Enrichment // added by the enrich pipeline
+	GDPRApplies      bool               // query param gdpr=1
+	ConsentString    string             // query param gdpr_consent
+	IssuedAt         time.Time          // when the cookie was minted, or first seen
+	Tags             []string           // set by the rules engine
+	SuppressMacros   []string           // redirect macros the rules engine blanks
+	Consents         []ConsentRecord    // consent signals seen for this cookie, oldest first
 }
 
 // Store the partner's user id (cookie id) and redirect to the endpoint of their choice with our cookie id.
@@ -50,22 +135,91 @@ func (x *MonsterServer) CookieSync(w http.ResponseWriter, r *http.Request) {
 
 	ci.PartnerCookieID = r.URL.Query().Get("pcid")
 	ci.PartnerID = r.URL.Query().Get("pid")
+	ci.ClientIP = x.ClientIP(r)
+
+	// over the limit, answer before minting a cookie or storing anything
+	if x.limiter != nil {
+		if ok, by := x.limiter.Allow(ci.ClientIP, ci.PartnerID); !ok {
+			log.Debug().Str("component", "limiter").Str("by", by).Str("client", ci.ClientIP).Str("pid", ci.PartnerID).Msg("rate limited")
+			w.WriteHeader(x.core.Config.RateLimitStatus)
+			return
+		}
+	}
 
 	// TODO:  validate partner identity and update partner usage counter
 
 	ci.PartnerEmailHash = r.URL.Query().Get("hem")
 	ci.RedirectURL = r.URL.Query().Get("r")
-	ci.ClientIP = r.Header.Get("X-Forwarded-For")
-	if ci.ClientIP == "" {
-		ci.ClientIP = r.Host
-	}
 	ci.UserAgent = r.Header.Get("User-Agent")
+	ci.ClientHints = utils.ReadClientHints(r.Header)
+	ci.GDPRApplies = r.URL.Query().Get("gdpr") == "1"
+	ci.ConsentString = r.URL.Query().Get("gdpr_consent")
+
+	store := true
+	trafficClass := TRAFFIC_HUMAN
+	if x.traffic != nil {
+		class, action := x.traffic.Classify(ci.UserAgent, ci.ClientIP)
+		trafficClass = class
+		switch action {
+		case ACTION_DROP:
+			log.Debug().Str("component", "traffic").Str("class", class).Str("client", ci.ClientIP).Msg("dropped")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case ACTION_SKIP:
+			store = false
+		case ACTION_TAG:
+			ci.Traffic = class
+		}
+	}
+
+	// shared exit addresses must not link unrelated browsers
+	if x.anonymizer != nil {
+		ci.Anonymizer = x.anonymizer.Classify(ci.ClientIP)
+	}
+
+	// geo needs the full address, look it up before anything truncates ClientIP
+	if x.geo != nil {
+		ci.Geo, _ = x.geo.Lookup(ci.ClientIP)
+	}
+
 	cookie, err := r.Cookie(MY_COOKIE_ID)
-	if err != nil {
+	newCookie := err != nil
+	if newCookie {
 		ci.MyCookieID = uuid.NewString()
+		ci.IssuedAt = time.Now().UTC()
 	} else {
 		ci.MyCookieID = cookie.Value
+		prior := x.FindCookie(ci.MyCookieID)
+		ci.IssuedAt = prior.IssuedAt
+		ci.Consents = prior.Consents
+		if ci.IssuedAt.IsZero() {
+			// cached before issue dates were kept, age it from now on
+			ci.IssuedAt = time.Now().UTC()
+		}
+	}
+	if r.URL.Query().Has("gdpr") || ci.ConsentString != "" {
+		ci.Consents = RecordConsent(ci.Consents, ConsentRecord{
+			At:          time.Now().UTC(),
+			PartnerID:   ci.PartnerID,
+			GDPRApplies: ci.GDPRApplies,
+			Consent:     ci.ConsentString})
+	}
+
+	// policy runs before a cookie is set or anything stored
+	if x.core.Rules != nil {
+		decision := x.core.Rules.Evaluate(x.ruleFacts(ci, trafficClass, newCookie))
+		if decision.Denied() {
+			log.Debug().Str("component", "rules").Strs("matched", decision.Matched).Str("client", ci.ClientIP).Str("pid", ci.PartnerID).Msg("sync denied")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if decision.Redirect != "" {
+			ci.RedirectURL = decision.Redirect
+		}
+		ci.SuppressMacros = decision.SuppressMacros
+		ci.Tags = decision.Tags
 	}
+
 	cookie = &http.Cookie{}
 	cookie.Domain = x.core.Config.CookieDomain
 	cookie.HttpOnly = true
@@ -76,6 +230,7 @@ func (x *MonsterServer) CookieSync(w http.ResponseWriter, r *http.Request) {
 	cookie.Secure = true
 	cookie.Value = ci.MyCookieID
 	http.SetCookie(w, cookie)
+	x.AcceptClientHints(w)
 
 	log.Debug().Str("component", "monster").Str("user-agent", ci.UserAgent).Str("cookie-id", ci.MyCookieID).Str("client", ci.ClientIP).Msg("inputs")
 
@@ -84,7 +239,10 @@ func (x *MonsterServer) CookieSync(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// sync our db
-	x.SyncCookie(ci)
+	if store {
+		x.enrich.Run(r.Context(), ENRICH_SYNC, &ci)
+		x.SyncCookie(ci)
+	}
 
 	// redirect is optional
 	if ci.RedirectURL == "" {
@@ -95,6 +253,76 @@ func (x *MonsterServer) CookieSync(w http.ResponseWriter, r *http.Request) {
 	log.Debug().Int64("microseconds", time.Now().UnixMicro()-startTime).Msg("elapsed time")
 }
 
+// What the rules engine can match on for this sync.
+func (x *MonsterServer) ruleFacts(ci CookieInfo, trafficClass string, newCookie bool) engine.Facts {
+	ua := utils.ParseUserAgentWithHints(ci.UserAgent, ci.ClientHints)
+	return engine.Facts{
+		PartnerID:     ci.PartnerID,
+		Country:       ci.Geo.Country,
+		Region:        ci.Geo.Region,
+		ASN:           ci.Geo.ASN,
+		GDPRApplies:   ci.GDPRApplies,
+		Consent:       !ci.GDPRApplies || ci.ConsentString != "",
+		Traffic:       trafficClass,
+		Anonymizer:    ci.Anonymizer,
+		DeviceType:    ua.DeviceType,
+		BrowserFamily: ua.BrowserFamily,
+		OSFamily:      ua.OSFamily,
+		NewCookie:     newCookie,
+		CookieAge:     time.Since(ci.IssuedAt)}
+}
+
+// Ask for the high entropy UA hints on the next request, the reduced UA string hides versions and models.
+// Third party contexts only receive them when the embedding page delegates via Permissions-Policy.
+func (x *MonsterServer) AcceptClientHints(w http.ResponseWriter) {
+	if !x.core.Config.ClientHints {
+		return
+	}
+	w.Header().Set("Accept-CH", strings.Join(utils.ClientHintHeaders, ", "))
+	if len(x.core.Config.CriticalHints) > 0 {
+		w.Header().Set("Critical-CH", strings.Join(x.core.Config.CriticalHints, ", "))
+	}
+	w.Header().Add("Vary", strings.Join(utils.ClientHintHeaders, ", "))
+}
+
+// The remote peer, or when the peer is a trusted proxy the right-most X-Forwarded-For hop that
+// is not one of ours.  Hops left of that were written by the client and prove nothing.
+func (x *MonsterServer) ClientIP(r *http.Request) string {
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		peer, err := netaddr.ParseIP(client)
+		if err != nil || !x.proxies.Contains(peer.Unmap()) {
+			break
+		}
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			break
+		}
+		client = hop
+	}
+	return client
+}
+
+// Proxies allowed to report the client address, CIDRs or single addresses.
+func TrustedProxies(entries []string) *netaddr.IPSet {
+	var builder netaddr.IPSetBuilder
+	for _, entry := range entries {
+		if !addIPSetEntry(&builder, strings.TrimSpace(entry)) {
+			log.Warn().Str("component", "monster").Str("proxy", entry).Msg("bad trusted proxy")
+		}
+	}
+	proxies, err := builder.IPSet()
+	if err != nil {
+		log.Error().Err(err).Str("component", "monster").Msg("trusted proxies")
+		return &netaddr.IPSet{}
+	}
+	return proxies
+}
+
 func (x *MonsterServer) Redirect(cm CookieInfo, w http.ResponseWriter, r *http.Request) {
 	redirectURL, err := url.QueryUnescape(cm.RedirectURL)
 	if err != nil {
@@ -105,6 +333,9 @@ func (x *MonsterServer) Redirect(cm CookieInfo, w http.ResponseWriter, r *http.R
 
 	log.Debug().Str("component", "monster").Str("redirect", redirectURL).Msg("redirect unescaped")
 
+	for _, macro := range cm.SuppressMacros {
+		redirectURL = strings.Replace(redirectURL, "${"+macro+"}", "", -1)
+	}
 	redirectURL = strings.Replace(redirectURL, "${DEVICE_ID}", cm.MyCookieID, -1)
 	redirectURL = strings.Replace(redirectURL, "${EHASH_SHA256_LOWERCASE}", cm.PartnerEmailHash, -1)
 
@@ -124,6 +355,35 @@ func (x *MonsterServer) FindCookie(myUID string) CookieInfo {
 func (x *MonsterServer) SyncCookie(newCI CookieInfo) {
 	// oldCI := x.FindCookie(newCI.MyCookieID)
 	// TODO:  sync cookie old/new
-	x.core.Cache.Set(newCI.MyCookieID, newCI, time.Duration(ONE_YEAR_SECONDS))
-	// TODO:  add to graph and consolodate graph in background
+	x.core.Cache.Set(newCI.MyCookieID, newCI, x.CacheTTL())
+	// TODO:  consolodate graph in background
+	if x.writer != nil {
+		x.writer.Enqueue(newCI)
+	}
+}
+
+// Each sync restarts the entry's ttl, so the retention window doubles as the cache's idle expiry.
+func (x *MonsterServer) CacheTTL() time.Duration {
+	if x.core.Config.RetentionWindow > 0 {
+		return x.core.Config.RetentionWindow
+	}
+	return ONE_YEAR_SECONDS * time.Second
+}
+
+// Stop the background reloaders, called on shutdown once the HTTP server has drained.
+func (x *MonsterServer) Close() {
+	if x.anonymizer != nil {
+		x.anonymizer.Close()
+	}
+	if x.geo != nil {
+		x.geo.Close()
+	}
+}
+
+// Drain pending graph writes, called on shutdown after the HTTP server stops accepting requests.
+func (x *MonsterServer) Flush(ctx context.Context) error {
+	if x.writer == nil {
+		return nil
+	}
+	return x.writer.Flush(ctx)
 }
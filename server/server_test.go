@@ -17,15 +17,15 @@ import (
 )
 
 func TestCookieSyncInCache(t *testing.T) {
-	router, _, config := InitServer(t)
+	router, cache, config := InitServer(t)
 	ci := InitCookieInfo(t)
-	//cache.On("Get", mock.Anything).Return(ci, true)
+	cache.On("Get", mock.Anything).Return(ci, true)
 
 	w := httptest.NewRecorder()
 	path := fmt.Sprintf("/csr?pcid=%s&pid=%s&hem=%s&r=%s", ci.PartnerCookieID, ci.PartnerID, ci.PartnerEmailHash, ci.RedirectURL)
 	req, _ := http.NewRequest(http.MethodGet, path, nil)
 	req.Header.Add("User-Agent", "test-user-agent")
-	req.Header.Add("X-Forwarded-For", "220.120.12.13")
+	req.RemoteAddr = "220.120.12.13:40000"
 	req.AddCookie(&http.Cookie{Name: MY_COOKIE_ID, Value: ci.MyCookieID})
 
 	router.ServeHTTP(w, req)
@@ -51,7 +51,7 @@ func TestCookieSyncRedirectTemplate(t *testing.T) {
 	path := fmt.Sprintf("/csr?pcid=%s&pid=%s&r=%s", ci.PartnerCookieID, ci.PartnerID, ci.RedirectURL)
 	req, _ := http.NewRequest(http.MethodGet, path, nil)
 	req.Header.Add("User-Agent", "test-user-agent")
-	req.Header.Add("X-Forwarded-For", "220.120.12.13")
+	req.RemoteAddr = "220.120.12.13:40000"
 	req.AddCookie(&http.Cookie{Name: MY_COOKIE_ID, Value: ci.MyCookieID})
 
 	router.ServeHTTP(w, req)
@@ -79,7 +79,7 @@ func TestCookieSyncNoRedirect(t *testing.T) {
 	path := fmt.Sprintf("/csr?pcid=%s&pid=%s", ci.PartnerCookieID, ci.PartnerID)
 	req, _ := http.NewRequest(http.MethodGet, path, nil)
 	req.Header.Add("User-Agent", "test-user-agent")
-	req.Header.Add("X-Forwarded-For", "220.120.12.13")
+	req.RemoteAddr = "220.120.12.13:40000"
 	req.AddCookie(&http.Cookie{Name: MY_COOKIE_ID, Value: ci.MyCookieID})
 
 	router.ServeHTTP(w, req)
@@ -95,6 +95,26 @@ func TestCookieSyncNoRedirect(t *testing.T) {
 	assert.Equal(t, expectedCookie, cookies[0])
 }
 
+func TestClientIP(t *testing.T) {
+	in := NewServer(utils.ServerCore{Config: utils.ServerConfig{TrustedProxies: []string{"10.0.0.0/8"}}})
+	client := func(remote string, forwarded ...string) string {
+		req, _ := http.NewRequest(http.MethodGet, "/csr", nil)
+		req.RemoteAddr = remote
+		for _, hop := range forwarded {
+			req.Header.Add("X-Forwarded-For", hop)
+		}
+		return in.ClientIP(req)
+	}
+
+	// straight from the client, whatever it claims
+	assert.Equal(t, "220.120.12.13", client("220.120.12.13:40000", "1.2.3.4"))
+	// through our proxies, the hop they appended
+	assert.Equal(t, "220.120.12.13", client("10.0.0.1:40000", "1.2.3.4, 220.120.12.13"))
+	assert.Equal(t, "220.120.12.13", client("10.0.0.1:40000", "1.2.3.4, 220.120.12.13", "10.0.0.2"))
+	// a proxy that forwarded nothing
+	assert.Equal(t, "10.0.0.1", client("10.0.0.1:40000"))
+}
+
 func InitServer(t *testing.T) (*chi.Mux, *MockCache, utils.ServerConfig) {
 	cache := NewMockCache(t)
 	cfg := utils.ServerConfig{CookieDomain: "a.osintami.com", PathPrefix: "/", LogLevel: "trace"}
@@ -155,3 +175,12 @@ func (x *MockCache) Get(key string) (interface{}, bool) {
 func (x *MockCache) Set(key string, value interface{}, d time.Duration) {
 	return
 }
+
+func (x *MockCache) Delete(key string) {
+	x.Called(key)
+}
+
+func (x *MockCache) Items() map[string]interface{} {
+	ret := x.Called()
+	return ret.Get(0).(map[string]interface{})
+}
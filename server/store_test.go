@@ -0,0 +1,370 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// Behaviour every IdentityStore shares, run offline against memory and against a live Dgraph.
+func testIdentityStore(t *testing.T, open func(t *testing.T) utils.IdentityStore) {
+	ctx := context.Background()
+	shared := utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"}
+
+	t.Run("create", func(t *testing.T) {
+		store := open(t)
+		created, err := store.CreateCookie(ctx, utils.Cookie{CookieID: "xyz123", Tags: []string{"new"},
+			Partners: []utils.Partner{{PartnerID: "pdq123", CookieID: "p1"}}})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, created.Uid)
+		assert.NotNil(t, created.IssuedAt)
+		// a cookie that never syncs still ages out of retention
+		assert.NotNil(t, created.SeenAt)
+		assert.True(t, created.IssuedAt.Equal(*created.SeenAt))
+
+		cookie, err := store.FindCookie(ctx, "xyz123")
+		assert.NoError(t, err)
+		assert.Equal(t, created.Uid, cookie.Uid)
+		assert.Equal(t, []string{"new"}, cookie.Tags)
+		assert.Equal(t, "p1", cookie.Partners[0].CookieID)
+
+		_, err = store.CreateCookie(ctx, utils.Cookie{CookieID: "xyz123"})
+		assert.Equal(t, utils.ErrCookieExists, err)
+		_, err = store.FindCookie(ctx, "abc789")
+		assert.Equal(t, utils.ErrCookieNotFound, err)
+	})
+
+	t.Run("link", func(t *testing.T) {
+		store := open(t)
+		_, err := store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, []string{"a"})
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, []string{"b"})
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", shared, utils.Partner{}, nil)
+		assert.NoError(t, err)
+
+		first, err := store.FindCookie(ctx, "xyz123")
+		assert.NoError(t, err)
+		second, err := store.FindCookie(ctx, "abc789")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, first.Tags)
+		assert.Equal(t, 1, len(first.Browsers))
+		assert.Equal(t, 2, first.Browsers[0].Hits)
+		assert.Equal(t, "pdq123", first.Browsers[0].Source)
+		assert.Equal(t, 2, first.Partners[0].Hits)
+		assert.Equal(t, first.Browsers[0].Uid, second.Browsers[0].Uid)
+		assert.Equal(t, 1, second.Browsers[0].Hits)
+		assert.NotNil(t, second.SeenAt)
+
+		browser, err := store.FindBrowser(ctx, shared.UserAgent, shared.Addr)
+		assert.NoError(t, err)
+		assert.Equal(t, first.Browsers[0].Uid, browser.Uid)
+
+		// an anonymizer address never links strangers
+		tor := utils.Browser{Addr: "185.220.101.1", UserAgent: "test-user-agent", Anonymizer: "tor"}
+		_, err = store.LinkCookie(ctx, "xyz123", tor, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", tor, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		_, err = store.FindBrowser(ctx, tor.UserAgent, tor.Addr)
+		assert.Equal(t, utils.ErrBrowserNotFound, err)
+	})
+
+	t.Run("partner lookup", func(t *testing.T) {
+		store := open(t)
+		_, err := store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p2"}, nil)
+		assert.NoError(t, err)
+
+		ids, err := store.FindCookieIDsByPartner(ctx, "p1")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"xyz123"}, ids)
+		ids, err = store.FindCookieIDsByPartner(ctx, "p3")
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		store := open(t)
+		own := utils.Browser{Addr: "220.120.12.14", UserAgent: "test-user-agent"}
+		_, err := store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, []string{"a"})
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", shared, utils.Partner{}, []string{"b"})
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", own, utils.Partner{PartnerID: "abc999", CookieID: "p2"}, nil)
+		assert.NoError(t, err)
+
+		_, err = store.MergeCookies(ctx, "xyz123", "xyz123")
+		assert.Equal(t, utils.ErrMergeSelf, err)
+		_, err = store.MergeCookies(ctx, "xyz123", "missing")
+		assert.Equal(t, utils.ErrCookieNotFound, err)
+
+		_, err = store.MergeCookies(ctx, "xyz123", "abc789")
+		assert.NoError(t, err)
+		_, err = store.FindCookie(ctx, "abc789")
+		assert.Equal(t, utils.ErrCookieNotFound, err)
+
+		merged, err := store.FindCookie(ctx, "xyz123")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, merged.Tags)
+		assert.Equal(t, 2, len(merged.Browsers))
+		assert.Equal(t, 2, len(merged.Partners))
+		for _, b := range merged.Browsers {
+			if b.Addr == shared.Addr {
+				assert.Equal(t, 2, b.Hits)
+				assert.Equal(t, "pdq123", b.Source)
+			} else {
+				assert.Equal(t, 1, b.Hits)
+			}
+		}
+	})
+
+	t.Run("erase", func(t *testing.T) {
+		store := open(t)
+		own := utils.Browser{Addr: "220.120.12.14", UserAgent: "test-user-agent",
+			Enrichments: []utils.Enrichment{{Enricher: "test", Attribute: utils.BoolAttr("risky", true)}}}
+		_, err := store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "xyz123", own, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p2"}, nil)
+		assert.NoError(t, err)
+
+		erased, err := store.EraseCookie(ctx, "xyz123")
+		assert.NoError(t, err)
+		types := map[string]int{}
+		for _, node := range erased {
+			types[node.Type]++
+		}
+		// the shared browser stays for abc789
+		assert.Equal(t, map[string]int{"Cookie": 1, "Browser": 1, "Enrichment": 1, "Partner": 1}, types)
+
+		_, err = store.FindBrowser(ctx, own.UserAgent, own.Addr)
+		assert.Equal(t, utils.ErrBrowserNotFound, err)
+		cookie, err := store.FindCookie(ctx, "abc789")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(cookie.Browsers))
+		_, err = store.EraseCookie(ctx, "xyz123")
+		assert.Equal(t, utils.ErrCookieNotFound, err)
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		store := open(t)
+		own := utils.Browser{Addr: "220.120.12.14", UserAgent: "test-user-agent"}
+		_, err := store.LinkCookie(ctx, "xyz123", shared, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+		assert.NoError(t, err)
+		// two hops from xyz123, through the browser and then the partner cookie
+		_, err = store.LinkCookie(ctx, "def456", own, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "ghi000", own, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "jkl111", utils.Browser{Addr: "220.120.12.15", UserAgent: "test-user-agent"}, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		// another partner's p1 is someone else, and cookies without a partner cookie share nothing
+		_, err = store.LinkCookie(ctx, "mno222", utils.Browser{}, utils.Partner{PartnerID: "xyz999", CookieID: "p1"}, nil)
+		assert.NoError(t, err)
+		for _, id := range []string{"pqr333", "stu444"} {
+			_, err = store.LinkCookie(ctx, id, utils.Browser{}, utils.Partner{PartnerID: "pdq123"}, nil)
+			assert.NoError(t, err)
+		}
+
+		cluster, err := store.FindCluster(ctx, "xyz123")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"abc789", "def456", "ghi000", "xyz123"}, cluster)
+		cluster, err = store.FindCluster(ctx, "jkl111")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"jkl111"}, cluster)
+		cluster, err = store.FindCluster(ctx, "pqr333")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"pqr333"}, cluster)
+		_, err = store.FindCluster(ctx, "missing")
+		assert.Equal(t, utils.ErrCookieNotFound, err)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		store := open(t)
+		own := utils.Browser{Addr: "220.120.12.14", UserAgent: "test-user-agent",
+			Enrichments: []utils.Enrichment{{Enricher: "test", Attribute: utils.BoolAttr("risky", true)}}}
+		_, err := store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, []string{"a"})
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "xyz123", shared, utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", shared, utils.Partner{}, nil)
+		assert.NoError(t, err)
+		_, err = store.LinkCookie(ctx, "abc789", own, utils.Partner{}, nil)
+		assert.NoError(t, err)
+
+		exported := []utils.Cookie{}
+		after := ""
+		for {
+			page, err := store.ScanCookies(ctx, after, 1)
+			assert.NoError(t, err)
+			if len(page) == 0 {
+				break
+			}
+			exported = append(exported, page...)
+			after = page[len(page)-1].Uid
+		}
+		assert.Equal(t, 2, len(exported))
+		_, err = store.RestoreCookie(ctx, exported[0])
+		assert.Equal(t, utils.ErrCookieExists, err)
+
+		// an export from before seen was tracked ages out from when the cookie was issued
+		issued := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+		old, err := store.RestoreCookie(ctx, utils.Cookie{CookieID: "old000", IssuedAt: &issued})
+		assert.NoError(t, err)
+		assert.True(t, issued.Equal(*old.SeenAt))
+
+		restored := open(t)
+		for _, cookie := range exported {
+			_, err := restored.RestoreCookie(ctx, cookie)
+			assert.NoError(t, err)
+		}
+		first, err := restored.FindCookie(ctx, "xyz123")
+		assert.NoError(t, err)
+		second, err := restored.FindCookie(ctx, "abc789")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, first.Tags)
+		assert.Equal(t, 2, first.Browsers[0].Hits)
+		assert.Equal(t, 2, first.Partners[0].Hits)
+		assert.Equal(t, "p1", first.Partners[0].CookieID)
+		// the browser both cookies share comes back as one node
+		assert.Equal(t, 2, len(second.Browsers))
+		assert.Equal(t, first.Browsers[0].Uid, second.Browsers[0].Uid)
+		assert.Equal(t, 1, len(second.Browsers[1].Enrichments))
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testIdentityStore(t, func(t *testing.T) utils.IdentityStore {
+		return utils.NewMemoryStore(2)
+	})
+}
+
+func TestSQLStore(t *testing.T) {
+	testIdentityStore(t, func(t *testing.T) utils.IdentityStore {
+		store, err := utils.NewSQLStore(utils.SQL_SQLITE, filepath.Join(t.TempDir(), "identity.db"), 2)
+		assert.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+// First syncs for a new cookie racing each other land on one row and count every hit.
+func TestSQLStoreConcurrentSync(t *testing.T) {
+	ctx := context.Background()
+	store, err := utils.NewSQLStore(utils.SQL_SQLITE, filepath.Join(t.TempDir(), "identity.db"), 2)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.LinkCookie(ctx, "xyz123", utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"},
+				utils.Partner{PartnerID: "pdq123", CookieID: "p1"}, nil)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	cookie, err := store.FindCookie(ctx, "xyz123")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cookie.Browsers))
+	assert.Equal(t, 8, cookie.Browsers[0].Hits)
+	assert.Equal(t, 8, cookie.Partners[0].Hits)
+}
+
+// Only the graph has a retention sweeper, and only syncs keep its seen stamps current.
+func TestRetentionConfig(t *testing.T) {
+	cfg := utils.ServerConfig{RateLimitStatus: http.StatusTooManyRequests, IdentityStore: utils.STORE_SQL, GraphSync: true}
+	assert.NoError(t, cfg.Validate())
+	cfg.RetentionWindow = time.Hour
+	assert.Equal(t, utils.ErrRetentionStore, cfg.Validate())
+	cfg.IdentityStore = utils.STORE_DGRAPH
+	assert.NoError(t, cfg.Validate())
+	cfg.GraphSync = false
+	assert.Equal(t, utils.ErrRetentionSync, cfg.Validate())
+}
+
+func TestDgraphStore(t *testing.T) {
+	testIdentityStore(t, func(t *testing.T) utils.IdentityStore {
+		dg, _ := InitDgraph(t)
+		return utils.NewDgraphStore(dg)
+	})
+}
+
+func TestCookieSyncWritesGraph(t *testing.T) {
+	store := utils.NewMemoryStore(2)
+	cache := utils.NewFileCache(filepath.Join(t.TempDir(), "cache.db"), false)
+	assert.NoError(t, cache.LoadFile())
+	in := NewServer(utils.ServerCore{Config: utils.ServerConfig{GraphSync: true, GraphQueueSize: 8}, Cache: cache, Graph: store})
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	sync := func(muid string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123", nil)
+		req.Header.Add("User-Agent", CHROME_UA)
+		req.RemoteAddr = "220.120.12.13:40000"
+		if muid != "" {
+			req.AddCookie(&http.Cookie{Name: MY_COOKIE_ID, Value: muid})
+		}
+		router.ServeHTTP(w, req)
+		return w.Result().Cookies()[0].Value
+	}
+	muid := sync("")
+	sync(muid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, in.Flush(ctx))
+
+	cookie, err := store.FindCookie(context.Background(), muid)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cookie.Browsers))
+	assert.Equal(t, 2, cookie.Browsers[0].Hits)
+	assert.Equal(t, "Chrome", cookie.Browsers[0].BrowserFamily)
+	assert.Equal(t, "abc", cookie.Partners[0].CookieID)
+
+	receipt, err := in.Erase(context.Background(), SUBJECT_PARTNER, "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{muid}, receipt.CookieIDs)
+	_, err = store.FindCookie(context.Background(), muid)
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+}
+
+// Without GRAPH_SYNC a sync only touches the cache.
+func TestCookieSyncGraphOff(t *testing.T) {
+	store := utils.NewMemoryStore(2)
+	cache := utils.NewFileCache(filepath.Join(t.TempDir(), "cache.db"), false)
+	assert.NoError(t, cache.LoadFile())
+	in := NewServer(utils.ServerCore{Cache: cache, Graph: store})
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123", nil)
+	req.Header.Add("User-Agent", CHROME_UA)
+	router.ServeHTTP(w, req)
+	muid := w.Result().Cookies()[0].Value
+	assert.NoError(t, in.Flush(context.Background()))
+
+	_, ok := cache.Get(muid)
+	assert.True(t, ok)
+	_, err := store.FindCookie(context.Background(), muid)
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+}
@@ -0,0 +1,74 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/osintami/monster/utils"
+)
+
+// how an erasure or access request names the person
+const (
+	SUBJECT_MUID    = "muid"
+	SUBJECT_PARTNER = "pcid"
+	SUBJECT_HEM     = "hem"
+)
+
+var ErrSubject = errors.New("need one of muid, pcid or hem")
+
+// Our cookie ids for a person named by muid, partner cookie id or email hash, sorted.
+// Partner and email hash lookups scan the whole cache, graph may be nil.
+func ResolveSubject(ctx context.Context, cache utils.ICache, graph utils.IdentityStore, by string, value string) ([]string, error) {
+	if value == "" {
+		return nil, ErrSubject
+	}
+	muids := map[string]bool{}
+	switch by {
+	case SUBJECT_MUID:
+		muids[value] = true
+	case SUBJECT_PARTNER, SUBJECT_HEM:
+		for key, item := range cache.Items() {
+			ci, ok := item.(CookieInfo)
+			if !ok {
+				continue
+			}
+			if (by == SUBJECT_PARTNER && ci.PartnerCookieID == value) || (by == SUBJECT_HEM && ci.PartnerEmailHash == value) {
+				muids[key] = true
+			}
+		}
+		if by == SUBJECT_PARTNER && graph != nil {
+			ids, err := graph.FindCookieIDsByPartner(ctx, value)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				muids[id] = true
+			}
+		}
+	default:
+		return nil, ErrSubject
+	}
+	return sortedKeys(muids), nil
+}
+
+// The first of muid, pcid or hem present in the query.
+func subjectParam(r *http.Request) (string, string) {
+	for _, by := range []string{SUBJECT_MUID, SUBJECT_PARTNER, SUBJECT_HEM} {
+		if value := r.URL.Query().Get(by); value != "" {
+			return by, value
+		}
+	}
+	return "", ""
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,23 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// Plain HTTP handler that sends every request to the same host and path over HTTPS.
+func HTTPSRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,84 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	handler := HTTPSRedirect(":8443")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://a.osintami.com:8080/csr?pid=abc", nil)
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://a.osintami.com:8443/csr?pid=abc", w.Header().Get("Location"))
+
+	handler = HTTPSRedirect(":443")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "https://a.osintami.com/csr?pid=abc", w.Header().Get("Location"))
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	WriteTestCert(t, certFile, keyFile, "first")
+
+	certs, err := utils.NewCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	defer certs.Close()
+	assert.Equal(t, "first", leafName(t, certs))
+
+	// a bad pair keeps the old certificate
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	assert.Error(t, certs.Reload())
+	assert.Equal(t, "first", leafName(t, certs))
+
+	WriteTestCert(t, certFile, keyFile, "second")
+	assert.NoError(t, certs.Reload())
+	assert.Equal(t, "second", leafName(t, certs))
+	assert.Contains(t, certs.TLSConfig().NextProtos, "h2")
+}
+
+func leafName(t *testing.T, certs *utils.CertReloader) string {
+	cert, err := certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func WriteTestCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
@@ -0,0 +1,210 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"inet.af/netaddr"
+
+	"github.com/osintami/monster/utils"
+)
+
+// traffic classes
+const (
+	TRAFFIC_HUMAN      = "human"
+	TRAFFIC_BOT        = "bot"
+	TRAFFIC_DATACENTER = "datacenter"
+)
+
+// what to do with a non-human class
+const (
+	ACTION_STORE = "store" // treat like a human
+	ACTION_TAG   = "tag"   // store, marking the Browser node with the class
+	ACTION_SKIP  = "skip"  // answer normally, store nothing
+	ACTION_DROP  = "drop"  // answer with a no-op, no cookie, store nothing
+)
+
+// used when the signature file is missing
+var DefaultBotSignatures = []string{
+	"bot", "crawler", "spider", "slurp", "headlesschrome", "phantomjs", "curl/", "wget/",
+	"python-requests", "python-urllib", "go-http-client", "java/", "okhttp", "libwww-perl", "scrapy"}
+
+// Flags bots by user-agent signature and cloud nodes by datacenter CIDR, before anything is stored.
+type TrafficClassifier struct {
+	signatures []string
+	datacenter *netaddr.IPSet
+	actions    map[string]string
+	counts     map[string]*uint64
+}
+
+func NewTrafficClassifier(signatures []string, datacenter *netaddr.IPSet, botAction, datacenterAction string) *TrafficClassifier {
+	lowered := make([]string, 0, len(signatures))
+	for _, sig := range signatures {
+		lowered = append(lowered, strings.ToLower(sig))
+	}
+	if datacenter == nil {
+		datacenter = &netaddr.IPSet{}
+	}
+	return &TrafficClassifier{
+		signatures: lowered,
+		datacenter: datacenter,
+		actions: map[string]string{
+			TRAFFIC_HUMAN:      ACTION_STORE,
+			TRAFFIC_BOT:        botAction,
+			TRAFFIC_DATACENTER: datacenterAction},
+		counts: map[string]*uint64{
+			TRAFFIC_HUMAN:      new(uint64),
+			TRAFFIC_BOT:        new(uint64),
+			TRAFFIC_DATACENTER: new(uint64)}}
+}
+
+// Build a classifier from the signature file and CIDR list files, missing files are skipped.
+func LoadTrafficClassifier(signatureFile string, cidrFiles []string, botAction, datacenterAction string) (*TrafficClassifier, error) {
+	signatures, err := ReadLines(signatureFile)
+	if os.IsNotExist(err) {
+		signatures = DefaultBotSignatures
+	} else if err != nil {
+		return nil, err
+	}
+
+	datacenter, err := LoadIPSet(cidrFiles)
+	if err != nil {
+		return nil, err
+	}
+	return NewTrafficClassifier(signatures, datacenter, botAction, datacenterAction), nil
+}
+
+// Classify the request and count it, returning the class and the action configured for it.
+func (x *TrafficClassifier) Classify(userAgent, clientIP string) (string, string) {
+	class := TRAFFIC_HUMAN
+	if x.isBot(userAgent) {
+		class = TRAFFIC_BOT
+	} else if ip, ok := ParseClientIP(clientIP); ok && x.datacenter.Contains(ip) {
+		class = TRAFFIC_DATACENTER
+	}
+
+	atomic.AddUint64(x.counts[class], 1)
+	return class, x.actions[class]
+}
+
+var ErrTrafficAction = errors.New("BOT_ACTION and DATACENTER_ACTION must be store, tag, skip or drop")
+
+// The config checks that need server constants on top of ServerConfig.Validate, main refuses to
+// start on an error.
+func ValidateConfig(cfg utils.ServerConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	for _, action := range []string{cfg.BotAction, cfg.DatacenterAction} {
+		switch action {
+		case ACTION_STORE, ACTION_TAG, ACTION_SKIP, ACTION_DROP:
+		default:
+			return ErrTrafficAction
+		}
+	}
+	return nil
+}
+
+func (x *TrafficClassifier) isBot(userAgent string) bool {
+	if userAgent == "" {
+		return true
+	}
+	ua := strings.ToLower(userAgent)
+	for _, sig := range x.signatures {
+		if strings.Contains(ua, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *TrafficClassifier) Counts() map[string]uint64 {
+	counts := make(map[string]uint64, len(x.counts))
+	for class, count := range x.counts {
+		counts[class] = atomic.LoadUint64(count)
+	}
+	return counts
+}
+
+// Requests seen per traffic class since startup.
+func (x *MonsterServer) TrafficStats(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]uint64{}
+	if x.traffic != nil {
+		counts = x.traffic.Counts()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		log.Warn().Err(err).Str("component", "traffic").Msg("encode")
+	}
+}
+
+// The address ClientIP resolved, never a raw X-Forwarded-For value.
+func ParseClientIP(clientIP string) (netaddr.IP, bool) {
+	ip, err := netaddr.ParseIP(strings.TrimSpace(clientIP))
+	if err != nil {
+		return netaddr.IP{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// One CIDR or address per line, blank lines and # comments ignored, missing files are skipped.
+func LoadIPSet(files []string) (*netaddr.IPSet, error) {
+	var builder netaddr.IPSetBuilder
+	for _, file := range files {
+		lines, err := ReadLines(file)
+		if os.IsNotExist(err) {
+			log.Warn().Str("component", "traffic").Str("path", file).Msg("cidr list not found")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if !addIPSetEntry(&builder, line) {
+				log.Warn().Str("component", "traffic").Str("path", file).Str("line", line).Msg("bad cidr")
+			}
+		}
+	}
+	return builder.IPSet()
+}
+
+// Add a CIDR or a single address, false when it is neither.
+func addIPSetEntry(builder *netaddr.IPSetBuilder, entry string) bool {
+	if prefix, err := netaddr.ParseIPPrefix(entry); err == nil {
+		builder.AddPrefix(prefix.Masked())
+	} else if ip, err := netaddr.ParseIP(entry); err == nil {
+		builder.Add(ip.Unmap())
+	} else {
+		return false
+	}
+	return true
+}
+
+// Non-empty lines of a text file, trimmed, # comments dropped.
+func ReadLines(path string) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,132 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const CHROME_UA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.0.0 Safari/537.36"
+
+func TestTrafficClassify(t *testing.T) {
+	dir := t.TempDir()
+	cidrs := filepath.Join(dir, "aws.txt")
+	os.WriteFile(cidrs, []byte("# cloud\n3.0.0.0/9\n52.94.76.10\nnot-a-cidr\n"), 0600)
+
+	traffic, err := LoadTrafficClassifier(filepath.Join(dir, "missing.txt"), []string{cidrs}, ACTION_SKIP, ACTION_TAG)
+	assert.NoError(t, err)
+
+	class, action := traffic.Classify(CHROME_UA, "220.120.12.13")
+	assert.Equal(t, TRAFFIC_HUMAN, class)
+	assert.Equal(t, ACTION_STORE, action)
+
+	class, action = traffic.Classify("Googlebot/2.1 (+http://www.google.com/bot.html)", "220.120.12.13")
+	assert.Equal(t, TRAFFIC_BOT, class)
+	assert.Equal(t, ACTION_SKIP, action)
+
+	class, action = traffic.Classify(CHROME_UA, "3.12.1.1")
+	assert.Equal(t, TRAFFIC_DATACENTER, class)
+	assert.Equal(t, ACTION_TAG, action)
+
+	class, _ = traffic.Classify(CHROME_UA, "52.94.76.10")
+	assert.Equal(t, TRAFFIC_DATACENTER, class)
+
+	counts := traffic.Counts()
+	assert.Equal(t, uint64(1), counts[TRAFFIC_HUMAN])
+	assert.Equal(t, uint64(1), counts[TRAFFIC_BOT])
+	assert.Equal(t, uint64(2), counts[TRAFFIC_DATACENTER])
+}
+
+func TestTrafficActions(t *testing.T) {
+	cfg := utils.ServerConfig{RateLimitStatus: http.StatusTooManyRequests, BotAction: ACTION_SKIP, DatacenterAction: ACTION_TAG}
+	assert.NoError(t, ValidateConfig(cfg))
+	cfg.DatacenterAction = "block"
+	assert.Equal(t, ErrTrafficAction, ValidateConfig(cfg))
+	cfg.DatacenterAction = ""
+	assert.Equal(t, ErrTrafficAction, ValidateConfig(cfg))
+}
+
+// A cloud node cannot pass as human by claiming a residential address.
+func TestCookieSyncSpoofedForward(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "datacenter_cidrs.txt"), []byte("3.0.0.0/9\n"), 0600)
+	cache := NewMockCache(t)
+	cfg := utils.ServerConfig{
+		FSPath:           dir + "/",
+		TrafficFilter:    true,
+		BotSignatureFile: "bot_signatures.txt",
+		DatacenterFiles:  []string{"datacenter_cidrs.txt"},
+		BotAction:        ACTION_SKIP,
+		DatacenterAction: ACTION_DROP}
+	in := NewServer(utils.ServerCore{Config: cfg, Cache: cache})
+
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123", nil)
+	req.Header.Add("User-Agent", CHROME_UA)
+	req.Header.Add("X-Forwarded-For", "220.120.12.13")
+	req.RemoteAddr = "3.12.1.1:40000"
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, uint64(1), in.traffic.Counts()[TRAFFIC_DATACENTER])
+}
+
+func TestCookieSyncBotDropped(t *testing.T) {
+	cache := NewMockCache(t)
+	cfg := utils.ServerConfig{
+		CookieDomain:     "a.osintami.com",
+		FSPath:           t.TempDir() + "/",
+		TrafficFilter:    true,
+		BotSignatureFile: "bot_signatures.txt",
+		BotAction:        ACTION_DROP}
+	in := NewServer(utils.ServerCore{Config: cfg, Cache: cache})
+
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123&r=/next", nil)
+	req.Header.Add("User-Agent", "curl/7.85.0")
+	req.RemoteAddr = "220.120.12.13:40000"
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Result().Header["Set-Cookie"])
+	assert.Equal(t, uint64(1), in.traffic.Counts()[TRAFFIC_BOT])
+}
+
+func TestCookieSyncBotSkipped(t *testing.T) {
+	cache := NewMockCache(t)
+	cfg := utils.ServerConfig{
+		CookieDomain:     "a.osintami.com",
+		FSPath:           t.TempDir() + "/",
+		TrafficFilter:    true,
+		BotSignatureFile: "bot_signatures.txt",
+		BotAction:        ACTION_SKIP}
+	cache.On("Get", mock.Anything).Return(InitCookieInfo(t), true)
+	in := NewServer(utils.ServerCore{Config: cfg, Cache: cache})
+
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123&r=/next", nil)
+	req.Header.Add("User-Agent", "python-requests/2.28")
+	req.RemoteAddr = "220.120.12.13:40000"
+	router.ServeHTTP(w, req)
+
+	// the partner still gets its redirect, nothing is stored
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.NotEmpty(t, w.Result().Header["Set-Cookie"])
+}
@@ -0,0 +1,83 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTxn(t *testing.T) {
+	ctx := context.Background()
+	alpha := &fakeAlpha{aborts: 3}
+	addr := serveAlpha(t, alpha)
+	graph, err := utils.NewDgraph(utils.ServerConfig{DgraphSvrs: []string{addr}, DgraphRetryDeadline: 5 * time.Second})
+	assert.NoError(t, err)
+	defer graph.Close()
+
+	// the sync lands once the conflicting writers are done, read and written again each attempt
+	cookie, err := graph.LinkCookie(ctx, "xyz123",
+		utils.Browser{Addr: "220.120.12.13", UserAgent: "test-user-agent"},
+		utils.Partner{PartnerID: "pdq123", CookieID: "xyz456"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "0x1", cookie.Uid)
+	assert.Equal(t, 4, alpha.mutations)
+	assert.Equal(t, 1, alpha.commits)
+
+	// a writer that keeps losing gives up at the deadline
+	impatient, err := utils.NewDgraph(utils.ServerConfig{DgraphSvrs: []string{addr}, DgraphRetryDeadline: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	defer impatient.Close()
+	alpha.mu.Lock()
+	alpha.aborts = 1000
+	alpha.mu.Unlock()
+	start := time.Now()
+	err = impatient.DeleteCookie(ctx, nil, &utils.Cookie{Uid: "0x1"}, true)
+	assert.Equal(t, dgo.ErrAborted, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Greater(t, alpha.mutations, 5)
+	assert.Equal(t, 1, alpha.commits)
+
+	// anything else is not retried
+	err = impatient.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		return utils.ErrCookieNotFound
+	})
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+}
+
+func TestReadTxn(t *testing.T) {
+	ctx := context.Background()
+	alpha := &fakeAlpha{}
+	graph, err := utils.NewDgraph(utils.ServerConfig{DgraphSvrs: []string{serveAlpha(t, alpha)}, DgraphQueryTimeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	defer graph.Close()
+
+	// a lookup on its own reads best effort and never commits
+	_, err = graph.FindCookie(ctx, nil, "xyz123")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+	_, err = graph.FindBrowser(ctx, nil, "test-user-agent", "220.120.12.13")
+	assert.Equal(t, utils.ErrBrowserNotFound, err)
+	assert.Equal(t, 2, alpha.readOnly)
+
+	// inside a write it reads in the write's txn
+	txn := graph.NewTxn()
+	_, err = graph.FindCookie(ctx, txn, "xyz123")
+	assert.Equal(t, utils.ErrCookieNotFound, err)
+	txn.Discard(ctx)
+	assert.Equal(t, 2, alpha.readOnly)
+	assert.Equal(t, 3, alpha.queries)
+	assert.Equal(t, 0, alpha.commits)
+
+	// a slow alpha runs out the lookup's own deadline, not the caller's
+	alpha.mu.Lock()
+	alpha.delay = time.Second
+	alpha.mu.Unlock()
+	start := time.Now()
+	_, err = graph.FindCookie(ctx, nil, "xyz123")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/osintami/monster/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua       string
+		expected utils.UserAgent
+	}{
+		{CHROME_UA, utils.UserAgent{
+			BrowserFamily: "Chrome", BrowserVersion: "108.0.0.0", OSFamily: "Windows", OSVersion: "10", DeviceType: utils.DEVICE_DESKTOP}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.0.0 Safari/537.36 Edg/108.0.1462.54", utils.UserAgent{
+			BrowserFamily: "Edge", BrowserVersion: "108.0.1462.54", OSFamily: "Windows", OSVersion: "10", DeviceType: utils.DEVICE_DESKTOP}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 16_1_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Mobile/15E148 Safari/604.1", utils.UserAgent{
+			BrowserFamily: "Safari", BrowserVersion: "16.1", OSFamily: "iOS", OSVersion: "16.1.2", DeviceType: utils.DEVICE_MOBILE, DeviceVendor: "Apple"}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-S908B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/19.0 Chrome/102.0.5005.125 Mobile Safari/537.36", utils.UserAgent{
+			BrowserFamily: "Samsung Internet", BrowserVersion: "19.0", OSFamily: "Android", OSVersion: "13", DeviceType: utils.DEVICE_MOBILE, DeviceVendor: "Samsung"}},
+		{"Mozilla/5.0 (Linux; Android 12; Pixel C) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.0.0 Safari/537.36", utils.UserAgent{
+			BrowserFamily: "Chrome", BrowserVersion: "108.0.0.0", OSFamily: "Android", OSVersion: "12", DeviceType: utils.DEVICE_TABLET, DeviceVendor: "Google"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:107.0) Gecko/20100101 Firefox/107.0", utils.UserAgent{
+			BrowserFamily: "Firefox", BrowserVersion: "107.0", OSFamily: "Mac OS X", OSVersion: "10.15", DeviceType: utils.DEVICE_DESKTOP, DeviceVendor: "Apple"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", utils.UserAgent{
+			BrowserFamily: "Bot", BrowserVersion: "2.1", DeviceType: utils.DEVICE_BOT}},
+		{"", utils.UserAgent{DeviceType: utils.DEVICE_OTHER}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, utils.ParseUserAgent(test.ua), test.ua)
+	}
+	assert.Equal(t, 108, utils.ParseUserAgent(CHROME_UA).BrowserMajor())
+}
+
+func TestParseUserAgentWithHints(t *testing.T) {
+	// reduced UA, the real versions only come through the hints
+	ua := "Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/110.0.0.0 Mobile Safari/537.36"
+	header := http.Header{}
+	header.Set("Sec-CH-UA", `"Chromium";v="110", "Not A(Brand";v="24", "Google Chrome";v="110"`)
+	header.Set("Sec-CH-UA-Full-Version-List", `"Chromium";v="110.0.5481.65", "Not A(Brand";v="24.0.0.0", "Google Chrome";v="110.0.5481.65"`)
+	header.Set("Sec-CH-UA-Mobile", "?1")
+	header.Set("Sec-CH-UA-Platform", `"Android"`)
+	header.Set("Sec-CH-UA-Platform-Version", `"13.0.0"`)
+	header.Set("Sec-CH-UA-Model", `"SM-S908B"`)
+
+	hints := utils.ReadClientHints(header)
+	assert.Equal(t, "Android", hints.Platform)
+	assert.Equal(t, "SM-S908B", hints.Model)
+
+	parsed := utils.ParseUserAgentWithHints(ua, hints)
+	assert.Equal(t, "Chrome", parsed.BrowserFamily)
+	assert.Equal(t, "110.0.5481.65", parsed.BrowserVersion)
+	assert.Equal(t, "Android", parsed.OSFamily)
+	assert.Equal(t, "13.0.0", parsed.OSVersion)
+	assert.Equal(t, utils.DEVICE_MOBILE, parsed.DeviceType)
+	assert.Equal(t, "Samsung", parsed.DeviceVendor)
+
+	// windows 11 only shows up as a platform version of 13 or more
+	header = http.Header{}
+	header.Set("Sec-CH-UA", `"Microsoft Edge";v="110", "Not A(Brand";v="24", "Chromium";v="110"`)
+	header.Set("Sec-CH-UA-Platform", `"Windows"`)
+	header.Set("Sec-CH-UA-Platform-Version", `"15.0.0"`)
+	parsed = utils.ParseUserAgentWithHints(CHROME_UA, utils.ReadClientHints(header))
+	assert.Equal(t, "Edge", parsed.BrowserFamily)
+	assert.Equal(t, "11", parsed.OSVersion)
+
+	assert.Equal(t, utils.ParseUserAgent(CHROME_UA), utils.ParseUserAgentWithHints(CHROME_UA, utils.ClientHints{}))
+}
+
+func TestCookieSyncAcceptCH(t *testing.T) {
+	cache := NewMockCache(t)
+	cfg := utils.ServerConfig{
+		CookieDomain:  "a.osintami.com",
+		ClientHints:   true,
+		CriticalHints: []string{"Sec-CH-UA-Platform-Version"}}
+	cache.On("Get", mock.Anything).Return(InitCookieInfo(t), true)
+	in := NewServer(utils.ServerCore{Config: cfg, Cache: cache})
+
+	router := chi.NewMux()
+	router.Get("/csr", in.CookieSync)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/csr?pcid=abc&pid=pdq123", nil)
+	req.Header.Add("User-Agent", CHROME_UA)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Contains(t, w.Header().Get("Accept-CH"), "Sec-CH-UA-Full-Version-List")
+	assert.Equal(t, "Sec-CH-UA-Platform-Version", w.Header().Get("Critical-CH"))
+}
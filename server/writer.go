@@ -0,0 +1,91 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/osintami/monster/utils"
+)
+
+type WriteFunc func(ctx context.Context, ci CookieInfo) error
+
+// Moves graph writes off the sync path, handlers enqueue and a single worker drains to Dgraph.
+type GraphWriter struct {
+	write  WriteFunc
+	queue  chan CookieInfo
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewGraphWriter(write WriteFunc, size int) *GraphWriter {
+	return &GraphWriter{
+		write: write,
+		queue: make(chan CookieInfo, size),
+		done:  make(chan struct{})}
+}
+
+func (x *GraphWriter) Start() {
+	go func() {
+		defer close(x.done)
+		for ci := range x.queue {
+			if err := x.write(context.Background(), ci); err != nil {
+				log.Error().Err(err).Str("component", "writer").Str("cookie-id", ci.MyCookieID).Msg("write")
+			}
+		}
+	}()
+}
+
+// Queue a write, returns false if the queue is full or the writer is shutting down.
+func (x *GraphWriter) Enqueue(ci CookieInfo) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.closed {
+		return false
+	}
+	select {
+	case x.queue <- ci:
+		return true
+	default:
+		log.Warn().Str("component", "writer").Str("cookie-id", ci.MyCookieID).Msg("queue full, dropped")
+		return false
+	}
+}
+
+// Stop accepting writes and wait for the queue to drain or the context to expire.
+func (x *GraphWriter) Flush(ctx context.Context) error {
+	x.mu.Lock()
+	if !x.closed {
+		x.closed = true
+		close(x.queue)
+	}
+	x.mu.Unlock()
+
+	select {
+	case <-x.done:
+		return nil
+	case <-ctx.Done():
+		log.Warn().Int("pending", len(x.queue)).Str("component", "writer").Msg("flush deadline")
+		return ctx.Err()
+	}
+}
+
+// Persist one sync to the graph.
+func (x *MonsterServer) writeGraph(ctx context.Context, ci CookieInfo) error {
+	x.enrich.Run(ctx, ENRICH_BACKGROUND, &ci)
+	browser := utils.Browser{
+		Addr:        ci.ClientIP,
+		UserAgent:   ci.UserAgent,
+		Traffic:     ci.Traffic,
+		Anonymizer:  ci.Anonymizer,
+		ClientHints: ci.ClientHints,
+		Geo:         ci.Geo,
+		Enrichments: ci.Enrichments}
+	browser.SetUserAgent(utils.ParseUserAgentWithHints(ci.UserAgent, ci.ClientHints))
+	partner := utils.Partner{PartnerID: ci.PartnerID, CookieID: ci.PartnerCookieID}
+	_, err := x.core.Graph.LinkCookie(ctx, ci.MyCookieID, browser, partner, ci.Tags)
+	return err
+}
@@ -0,0 +1,61 @@
+// © 2022 Sloan Childers
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphWriterFlush(t *testing.T) {
+	var mu sync.Mutex
+	written := []string{}
+	writer := NewGraphWriter(func(ctx context.Context, ci CookieInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, ci.MyCookieID)
+		return nil
+	}, 10)
+	writer.Start()
+
+	assert.True(t, writer.Enqueue(CookieInfo{MyCookieID: "a"}))
+	assert.True(t, writer.Enqueue(CookieInfo{MyCookieID: "b"}))
+
+	err := writer.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, written)
+
+	// closed for business after a flush
+	assert.False(t, writer.Enqueue(CookieInfo{MyCookieID: "c"}))
+	assert.NoError(t, writer.Flush(context.Background()))
+}
+
+func TestGraphWriterFlushDeadline(t *testing.T) {
+	release := make(chan struct{})
+	writer := NewGraphWriter(func(ctx context.Context, ci CookieInfo) error {
+		<-release
+		return nil
+	}, 10)
+	writer.Start()
+	defer close(release)
+
+	assert.True(t, writer.Enqueue(CookieInfo{MyCookieID: "a"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := writer.Flush(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestGraphWriterQueueFull(t *testing.T) {
+	writer := NewGraphWriter(func(ctx context.Context, ci CookieInfo) error {
+		return nil
+	}, 1)
+
+	// worker not started, the second write has nowhere to go
+	assert.True(t, writer.Enqueue(CookieInfo{MyCookieID: "a"}))
+	assert.False(t, writer.Enqueue(CookieInfo{MyCookieID: "b"}))
+}
@@ -0,0 +1,486 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	JOURNAL_SUFFIX  = ".journal"
+	SNAPSHOT_SUFFIX = ".tmp"
+	CORRUPT_SUFFIX  = ".corrupt"
+	CLEANUP_PERIOD  = 10 * time.Minute
+	MAX_JOURNAL_REC = 1 << 20
+)
+
+// In-memory cache persisted to disk as periodic snapshots plus an optional append-only journal.
+//
+// Snapshots are written to a temp file and renamed over the old one, so a crash never leaves a
+// half written cache.db.  With the journal on, every Set is appended to cache.db.journal; each
+// snapshot rotates the live journal to cache.db.journal.<seq> and records <seq> in the snapshot,
+// so startup loads the snapshot, replays any newer rotated journals and then the live journal.
+// Journal writes are not fsync'd, they survive a process crash or OOM kill but not power loss.
+type FileCache struct {
+	cache    *gocache.Cache
+	path     string
+	journal  bool
+	mu       sync.Mutex
+	saveMu   sync.Mutex
+	jfile    *os.File
+	stop     chan struct{}
+	once     sync.Once
+	loaded   bool
+	readOnly bool
+}
+
+type snapshot struct {
+	Seq   int64
+	Items map[string]gocache.Item
+}
+
+type journalEntry struct {
+	Key     string
+	Value   interface{}
+	Expires int64
+	Deleted bool
+}
+
+var ErrJournalCorrupt = errors.New("journal corrupt")
+var ErrCacheNotLoaded = errors.New("cache not loaded")
+var ErrCacheReadOnly = errors.New("cache opened read-only")
+
+// Values stored as interface{} must be registered with encoding/gob by their owner.
+func NewFileCache(path string, journal bool) *FileCache {
+	return &FileCache{
+		cache:   gocache.New(gocache.NoExpiration, CLEANUP_PERIOD),
+		path:    path,
+		journal: journal,
+		stop:    make(chan struct{})}
+}
+
+// For tools reading the files of a running server, loading leaves every file as it is and
+// nothing is ever written back.
+func (x *FileCache) ReadOnly() *FileCache {
+	x.readOnly = true
+	x.journal = false
+	return x
+}
+
+func (x *FileCache) Get(key string) (interface{}, bool) {
+	return x.cache.Get(key)
+}
+
+func (x *FileCache) Set(key string, value interface{}, duration time.Duration) {
+	if !x.journal {
+		x.cache.Set(key, value, duration)
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.cache.Set(key, value, duration)
+	if x.jfile == nil {
+		return
+	}
+	entry := journalEntry{Key: key, Value: value}
+	if duration > 0 {
+		entry.Expires = time.Now().Add(duration).UnixNano()
+	}
+	if err := writeJournalEntry(x.jfile, entry); err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("key", key).Msg("journal append")
+	}
+}
+
+func (x *FileCache) Delete(key string) {
+	if !x.journal {
+		x.cache.Delete(key)
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.cache.Delete(key)
+	if x.jfile == nil {
+		return
+	}
+	if err := writeJournalEntry(x.jfile, journalEntry{Key: key, Deleted: true}); err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("key", key).Msg("journal append")
+	}
+}
+
+// A copy of every unexpired entry, a full scan so keep it off the request path.
+func (x *FileCache) Items() map[string]interface{} {
+	items := x.cache.Items()
+	values := make(map[string]interface{}, len(items))
+	for key, item := range items {
+		values[key] = item.Object
+	}
+	return values
+}
+
+// Restore the snapshot and replay the journals written since, then open the live journal.
+func (x *FileCache) LoadFile() error {
+	seq, err := x.loadSnapshot()
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("component", "cache").Str("path", x.path).Msg("load snapshot")
+		return err
+	}
+
+	rotated, err := x.rotatedJournals()
+	if err != nil {
+		return err
+	}
+	for _, r := range rotated {
+		if r.seq <= seq {
+			if !x.readOnly {
+				os.Remove(r.path)
+			}
+			continue
+		}
+		if _, err := x.replayJournal(r.path); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("component", "cache").Str("path", r.path).Msg("replay rotated journal")
+		}
+	}
+
+	live := x.path + JOURNAL_SUFFIX
+	good, err := x.replayJournal(live)
+	if err != nil && !os.IsNotExist(err) && !x.readOnly {
+		// keep what replayed cleanly and cut the torn tail so appends stay readable
+		log.Warn().Err(err).Str("component", "cache").Int64("offset", good).Msg("replay journal")
+		if err := os.Truncate(live, good); err != nil {
+			return err
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.loaded = true
+	if !x.journal {
+		return nil
+	}
+	return x.openJournal()
+}
+
+// Write an atomic snapshot, rotating the live journal so it only holds writes made after it.
+func (x *FileCache) SaveFile() error {
+	if x.readOnly {
+		return ErrCacheReadOnly
+	}
+	x.saveMu.Lock()
+	defer x.saveMu.Unlock()
+
+	x.mu.Lock()
+	// saving before the replay would rotate away journal entries that are not in memory yet
+	if !x.loaded {
+		x.mu.Unlock()
+		return ErrCacheNotLoaded
+	}
+	x.trim()
+	seq := time.Now().UnixNano()
+	if err := x.rotateJournal(seq); err != nil {
+		x.mu.Unlock()
+		log.Error().Err(err).Str("component", "cache").Msg("rotate journal")
+		return err
+	}
+	items := x.cache.Items()
+	x.mu.Unlock()
+
+	if err := x.writeSnapshot(snapshot{Seq: seq, Items: items}); err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("path", x.path).Msg("save snapshot")
+		return err
+	}
+
+	rotated, err := x.rotatedJournals()
+	if err != nil {
+		return err
+	}
+	for _, r := range rotated {
+		if r.seq <= seq {
+			os.Remove(r.path)
+		}
+	}
+	log.Debug().Str("component", "cache").Int("items", len(items)).Msg("snapshot saved")
+	return nil
+}
+
+// Drop entries past their ttl so the snapshot and memory only hold what is retained, the journal
+// already carries each entry's expiry so nothing needs writing for them.
+func (x *FileCache) trim() {
+	before := x.cache.ItemCount()
+	x.cache.DeleteExpired()
+	if trimmed := before - x.cache.ItemCount(); trimmed > 0 {
+		log.Debug().Str("component", "cache").Int("trimmed", trimmed).Msg("expired entries")
+	}
+}
+
+// Snapshot on a fixed interval until Close is called.
+func (x *FileCache) StartSnapshots(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				x.SaveFile()
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *FileCache) Close() error {
+	x.once.Do(func() { close(x.stop) })
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.jfile == nil {
+		return nil
+	}
+	err := x.jfile.Close()
+	x.jfile = nil
+	return err
+}
+
+func (x *FileCache) loadSnapshot() (int64, error) {
+	fh, err := os.Open(x.path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	var snap snapshot
+	if err := gob.NewDecoder(bufio.NewReader(fh)).Decode(&snap); err != nil {
+		items, lerr := loadLegacySnapshot(x.path)
+		if lerr != nil {
+			x.moveAside(err)
+			return 0, nil
+		}
+		log.Warn().Str("component", "cache").Str("path", x.path).Msg("importing a pre-journal cache.db")
+		snap = snapshot{Items: items}
+	}
+
+	now := time.Now().UnixNano()
+	for key, item := range snap.Items {
+		if item.Expiration > 0 && item.Expiration <= now {
+			continue
+		}
+		x.cache.Set(key, item.Object, remaining(item.Expiration, now))
+	}
+	log.Info().Str("component", "cache").Int("items", x.cache.ItemCount()).Msg("snapshot loaded")
+	return snap.Seq, nil
+}
+
+// cache.db as written before snapshots carried a sequence, the bare go-cache item map.
+func loadLegacySnapshot(path string) (map[string]gocache.Item, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	items := map[string]gocache.Item{}
+	if err := gob.NewDecoder(bufio.NewReader(fh)).Decode(&items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// An unreadable cache.db is kept for inspection and startup carries on with an empty cache,
+// the next snapshot writes a fresh one.
+func (x *FileCache) moveAside(cause error) {
+	if x.readOnly {
+		log.Warn().Err(cause).Str("component", "cache").Str("path", x.path).Msg("unreadable snapshot ignored")
+		return
+	}
+	aside := x.path + CORRUPT_SUFFIX + "." + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := os.Rename(x.path, aside); err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("path", x.path).Msg("move unreadable snapshot")
+		return
+	}
+	log.Warn().Err(cause).Str("component", "cache").Str("moved", aside).Msg("unreadable snapshot moved aside")
+}
+
+func (x *FileCache) writeSnapshot(snap snapshot) error {
+	tmp := x.path + SNAPSHOT_SUFFIX
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fh)
+	err = gob.NewEncoder(w).Encode(snap)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, x.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(x.path))
+}
+
+// Apply every complete journal record, returning the offset of the last good one.
+func (x *FileCache) replayJournal(path string) (int64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+	var good int64
+	count := 0
+	now := time.Now().UnixNano()
+	for {
+		entry, n, err := readJournalEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return good, err
+		}
+		good += n
+		count++
+		if entry.Deleted || (entry.Expires > 0 && entry.Expires <= now) {
+			x.cache.Delete(entry.Key)
+			continue
+		}
+		x.cache.Set(entry.Key, entry.Value, remaining(entry.Expires, now))
+	}
+	log.Info().Str("component", "cache").Str("path", path).Int("entries", count).Msg("journal replayed")
+	return good, nil
+}
+
+// Caller holds x.mu.
+func (x *FileCache) openJournal() error {
+	fh, err := os.OpenFile(x.path+JOURNAL_SUFFIX, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error().Err(err).Str("component", "cache").Msg("open journal")
+		return err
+	}
+	x.jfile = fh
+	return nil
+}
+
+// Move the live journal aside as <seq>, a leftover journal is rotated even with journaling off.
+// Caller holds x.mu.
+func (x *FileCache) rotateJournal(seq int64) error {
+	if x.jfile != nil {
+		if err := x.jfile.Close(); err != nil {
+			return err
+		}
+		x.jfile = nil
+	}
+	live := x.path + JOURNAL_SUFFIX
+	if err := os.Rename(live, live+"."+strconv.FormatInt(seq, 10)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !x.journal {
+		return nil
+	}
+	return x.openJournal()
+}
+
+type rotatedJournal struct {
+	path string
+	seq  int64
+}
+
+func (x *FileCache) rotatedJournals() ([]rotatedJournal, error) {
+	prefix := x.path + JOURNAL_SUFFIX + "."
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	journals := []rotatedJournal{}
+	for _, match := range matches {
+		seq, err := strconv.ParseInt(strings.TrimPrefix(match, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		journals = append(journals, rotatedJournal{path: match, seq: seq})
+	}
+	sort.Slice(journals, func(i, j int) bool { return journals[i].seq < journals[j].seq })
+	return journals, nil
+}
+
+// Each record is a big-endian length followed by a self-contained gob, so a torn tail is detectable.
+func writeJournalEntry(w io.Writer, entry journalEntry) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	_, err := w.Write(record)
+	return err
+}
+
+func readJournalEntry(r io.Reader) (journalEntry, int64, error) {
+	var entry journalEntry
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return entry, 0, ErrJournalCorrupt
+		}
+		return entry, 0, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length > MAX_JOURNAL_REC {
+		return entry, 0, ErrJournalCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return entry, 0, ErrJournalCorrupt
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+		return entry, 0, ErrJournalCorrupt
+	}
+	return entry, int64(len(payload) + 4), nil
+}
+
+func remaining(expires int64, now int64) time.Duration {
+	if expires == 0 {
+		return gocache.NoExpiration
+	}
+	return time.Duration(expires - now)
+}
+
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
@@ -0,0 +1,112 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Serves the current certificate to the TLS handshake and swaps it when the files change or on SIGHUP.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	x := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{})}
+	if err := x.Reload(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Load the key pair from disk, the previous certificate stays in use if the new one is bad.
+func (x *CertReloader) Reload() error {
+	modTime := x.latestModTime()
+	cert, err := tls.LoadX509KeyPair(x.certFile, x.keyFile)
+	if err != nil {
+		log.Error().Err(err).Str("component", "tls").Str("cert", x.certFile).Msg("load key pair")
+		return err
+	}
+	x.mu.Lock()
+	x.cert = &cert
+	x.modTime = modTime
+	x.mu.Unlock()
+	log.Info().Str("component", "tls").Str("cert", x.certFile).Msg("certificate loaded")
+	return nil
+}
+
+func (x *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.cert, nil
+}
+
+// TLS settings for the public listener, HTTP/2 is negotiated ahead of HTTP/1.1.
+func (x *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: x.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"}}
+}
+
+// Poll the files for changes every interval and reload on SIGHUP, until Close.
+func (x *CertReloader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-hup:
+				x.Reload()
+			case <-tick:
+				x.mu.RLock()
+				changed := x.latestModTime().After(x.modTime)
+				x.mu.RUnlock()
+				if changed {
+					x.Reload()
+				}
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *CertReloader) Close() {
+	x.once.Do(func() { close(x.stop) })
+}
+
+func (x *CertReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{x.certFile, x.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -5,6 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/dgo/v2"
@@ -22,40 +25,123 @@ type BrowserResponse struct {
 }
 
 type Browser struct {
-	Uid       string `json:"uid,omitempty"`
-	Addr      string `json:"addr"`
-	UserAgent string `json:"useragent"`
-	Count     int    `json:"count"`
+	Uid        string `json:"uid,omitempty"`
+	Addr       string `json:"addr"`
+	UserAgent  string `json:"useragent"`
+	Count      int    `json:"count"` // never maintained, hits are counted per cookie on the edge facets
+	Traffic    string `json:"traffic,omitempty"`
+	Anonymizer string `json:"anonymizer,omitempty"`
+	// parsed from the user-agent so minor browser updates match the same node
+	BrowserFamily  string `json:"browser_family,omitempty"`
+	BrowserVersion string `json:"browser_version,omitempty"`
+	BrowserMajor   int    `json:"browser_major,omitempty"`
+	OSFamily       string `json:"os_family,omitempty"`
+	OSVersion      string `json:"os_version,omitempty"`
+	DeviceType     string `json:"device_type,omitempty"`
+	DeviceVendor   string `json:"device_vendor,omitempty"`
+	ClientHints
+	Geo
+	Enrichments []Enrichment `json:"enrichment,omitempty"`
+	// facets on the cookie's edge to this browser, only set when read or written through a cookie
+	FirstSeen *time.Time `json:"browser|first_seen,omitempty"`
+	LastSeen  *time.Time `json:"browser|last_seen,omitempty"`
+	Hits      int        `json:"browser|count,omitempty"`
+	Source    string     `json:"browser|source,omitempty"`
+	DType     []string   `json:"dgraph.type,omitempty"`
 }
 type Partner struct {
 	Uid       string `json:"uid,omitempty"`
 	PartnerID string `json:"pid"`
 	CookieID  string `json:"pcookie"`
+	// facets on the cookie's edge to this partner cookie
+	FirstSeen *time.Time `json:"partner|first_seen,omitempty"`
+	LastSeen  *time.Time `json:"partner|last_seen,omitempty"`
+	Hits      int        `json:"partner|count,omitempty"`
+	Source    string     `json:"partner|source,omitempty"`
+	DType     []string   `json:"dgraph.type,omitempty"`
 }
 type Cookie struct {
 	Uid      string     `json:"uid,omitempty"`
 	CookieID string     `json:"cookie"`
 	IssuedAt *time.Time `json:"issued"`
+	SeenAt   *time.Time `json:"seen,omitempty"`
 	Browsers []Browser  `json:"browser"`
 	Partners []Partner  `json:"partner"`
+	Tags     []string   `json:"tag,omitempty"`
+	DType    []string   `json:"dgraph.type,omitempty"`
 }
 
 type Dgraph struct {
-	dg *dgo.Dgraph
+	dg            *dgo.Dgraph
+	tolerance     int
+	retryDeadline time.Duration
+	queryTimeout  time.Duration
+	writeTimeout  time.Duration
+	conns         []*grpc.ClientConn
+	stop          chan struct{}
+	once          sync.Once
 }
 
+// predicates fetched for every Browser and Partner node
+const BROWSER_FIELDS = `
+	uid
+	addr
+	useragent
+	count
+	traffic
+	anonymizer
+	browser_family
+	browser_version
+	browser_major
+	os_family
+	os_version
+	device_type
+	device_vendor
+	ch_ua
+	ch_ua_full_version_list
+	ch_ua_mobile
+	ch_ua_platform
+	ch_ua_platform_version
+	ch_ua_model
+	ch_ua_arch
+	ch_ua_bitness
+	geo_country
+	geo_region
+	geo_city
+	geo_asn
+	geo_org
+	enrichment {` + ENRICHMENT_FIELDS + `}
+`
+
+const PARTNER_FIELDS = `
+	uid
+	pid
+	pcookie
+`
+
+const COOKIE_FIELDS = `
+	uid
+	cookie
+	issued
+	seen
+	tag
+	browser @facets {` + BROWSER_FIELDS + `}
+	partner @facets {` + PARTNER_FIELDS + `}
+`
+
 var ErrCookieNotFound = errors.New("cookie not found")
 var ErrBrowserNotFound = errors.New("browser not found")
 
 var ErrDuplicateCookiesExist = errors.New("duplicate cookies exist")
 
-func NewDgraph(cfg ServerConfig) *Dgraph {
-	conn, err := grpc.Dial(cfg.DgraphSvr, grpc.WithInsecure())
+// Ping runs a cheap read-only query to confirm an Alpha is reachable.
+func (x *Dgraph) Ping(ctx context.Context) error {
+	_, err := x.query(ctx, nil, `{ ping(func: uid(0x1)) { uid } }`, nil)
 	if err != nil {
-		log.Fatal().Err(err).Msg("connect")
+		log.Error().Err(err).Str("component", "dgraph").Msg("ping")
+		return err
 	}
-	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
-	return &Dgraph{dg: dg}
+	return nil
 }
 
 func (x *Dgraph) DropSchema(ctx context.Context) error {
@@ -66,50 +152,27 @@ func (x *Dgraph) DropData(ctx context.Context) error {
 	return x.dg.Alter(context.Background(), &api.Operation{DropOp: api.Operation_DATA})
 }
 
+// Bring the schema up to date by applying every migration the graph has not recorded yet.
 func (x *Dgraph) CreateSchema(ctx context.Context) error {
-
-	op := &api.Operation{}
-	op.Schema = `
-			cookie: string @index(hash) .
-			issued: datetime .
-			Browser: [uid] .
-			Partner: [uid] .
-			addr: string @index(hash) .
-			useragent: string @index(hash) .
-			count: int .
-			pid: string .
-			pcookie: string @index(hash) .
-	
-			type Browser {
-				addr: string
-				useragent: string
-				count: int
-			}		
-			type Partner {
-				pid: string!
-				pcookie: string!
-			}
-			type Cookie {
-				cookie: string! 
-				issued: datetime
-				Browser: [Browser]
-				Partner: [Partner]
-			}	
-		`
-
-	if err := x.dg.Alter(ctx, op); err != nil {
-		log.Error().Err(err).Str("component", "dgraph").Msg("schema")
-		return err
-	}
-	return nil
+	_, err := x.Migrate(ctx, Migrations)
+	return err
 }
 
+// Without a txn the browser is written and committed through RunTxn, commitNow only applies to
+// the caller's txn.
 func (x *Dgraph) CreateBrowser(ctx context.Context, txn *dgo.Txn, browser *Browser, commitNow bool) (*Browser, error) {
 
 	if txn == nil {
-		txn = x.dg.NewTxn()
+		var created *Browser
+		err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+			var err error
+			created, err = x.CreateBrowser(ctx, txn, browser, false)
+			return err
+		})
+		return created, err
 	}
 
+	browser.SetTypes()
 	mu := &api.Mutation{}
 	pb, err := json.Marshal(browser)
 	if err != nil {
@@ -135,11 +198,20 @@ func (x *Dgraph) CreateBrowser(ctx context.Context, txn *dgo.Txn, browser *Brows
 func (x *Dgraph) CreateCookie(ctx context.Context, txn *dgo.Txn, cookie *Cookie, commitNow bool) (*Cookie, error) {
 
 	if txn == nil {
-		txn = x.dg.NewTxn()
+		var created *Cookie
+		err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+			var err error
+			created, err = x.CreateCookie(ctx, txn, cookie, false)
+			return err
+		})
+		return created, err
 	}
 
+	// seen drives retention, a cookie that never syncs still ages out from when it was issued
 	createdAt := time.Now()
 	cookie.IssuedAt = &createdAt
+	cookie.SeenAt = &createdAt
+	cookie.SetTypes()
 
 	mu := &api.Mutation{}
 	pb, err := json.Marshal(cookie)
@@ -163,15 +235,19 @@ func (x *Dgraph) CreateCookie(ctx context.Context, txn *dgo.Txn, cookie *Cookie,
 	return x.FindCookieByUid(ctx, txn, uid)
 }
 
+// Remove the edges listed in cookie, the nodes stay.  EraseCookie removes a whole identity.
 func (x *Dgraph) DeleteCookie(ctx context.Context, txn *dgo.Txn, cookie *Cookie, commitNow bool) error {
 
+	if cookie == nil {
+		return ErrCookieNotFound
+	}
 	if txn == nil {
-		txn = x.dg.NewTxn()
+		return x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+			return x.DeleteCookie(ctx, txn, cookie, false)
+		})
 	}
 
-	mu := &api.Mutation{
-		CommitNow: true,
-	}
+	mu := &api.Mutation{}
 	pb, err := json.Marshal(cookie)
 	if err != nil {
 		log.Error().Err(err).Str("component", "dgraph").Str("command", "delete").Msg("marshal")
@@ -192,37 +268,212 @@ func (x *Dgraph) DeleteCookie(ctx context.Context, txn *dgo.Txn, cookie *Cookie,
 	return err
 }
 
+// Attach the browser, partner and tags to the cookie in one transaction, creating the cookie and
+// browser nodes when they do not exist yet.  Browsers are shared across cookies by (ua, ip).
+func (x *Dgraph) LinkCookie(ctx context.Context, cookieID string, browser Browser, partner Partner, tags []string) (*Cookie, error) {
+	var update *Cookie
+	err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		now := time.Now()
+		cookie, err := x.FindCookie(ctx, txn, cookieID)
+		if err == ErrCookieNotFound {
+			cookie = &Cookie{Uid: "_:cookie", CookieID: cookieID, IssuedAt: &now}
+		} else if err != nil && err != ErrDuplicateCookiesExist {
+			return err
+		}
+
+		update, err = linkUpdate(cookie, browser, partner, tags, now, func(b Browser) (*Browser, error) {
+			return x.findSimilarBrowser(ctx, txn, b)
+		})
+		if err != nil {
+			return err
+		}
+
+		update.SetTypes()
+		pb, err := json.Marshal(update)
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "link").Msg("marshal")
+			return err
+		}
+
+		resp, err := txn.Mutate(ctx, &api.Mutation{SetJson: pb})
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "link").Msg("mutate")
+			return err
+		}
+
+		if uid, ok := resp.GetUids()["cookie"]; ok {
+			update.Uid = uid
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// Fold the from cookie's browsers, partners and tags into the into cookie and delete from, in one
+// transaction.  Nodes stay, from's edges move across with their facets.
+func (x *Dgraph) MergeCookies(ctx context.Context, into string, from string) (*Cookie, error) {
+	if into == from {
+		return nil, ErrMergeSelf
+	}
+	var target *Cookie
+	err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		var err error
+		target, err = x.FindCookie(ctx, txn, into)
+		if err != nil && err != ErrDuplicateCookiesExist {
+			return err
+		}
+		source, err := x.FindCookie(ctx, txn, from)
+		if err != nil && err != ErrDuplicateCookiesExist {
+			return err
+		}
+		target.Merge(*source)
+		target.SetTypes()
+		pb, err := json.Marshal(target)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Mutate(ctx, &api.Mutation{SetJson: pb}); err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "merge").Msg("mutate")
+			return err
+		}
+		if err := deleteNodes(ctx, txn, []ErasedNode{{Type: "Cookie", Uid: source.Uid}}, false); err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "merge").Msg("delete")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// Count a sync on the cookie's edge to this browser, first_seen and source keep the first report.
+func (x *Browser) Touch(now time.Time, source string) {
+	if x.FirstSeen == nil {
+		x.FirstSeen = &now
+	}
+	if x.Source == "" {
+		x.Source = source
+	}
+	x.LastSeen = &now
+	x.Hits++
+}
+
+func (x *Partner) Touch(now time.Time, source string) {
+	if x.FirstSeen == nil {
+		x.FirstSeen = &now
+	}
+	if x.Source == "" {
+		x.Source = source
+	}
+	x.LastSeen = &now
+	x.Hits++
+}
+
+// Stamp dgraph.type on the cookie and every node nested in it, type() queries only see typed nodes.
+func (x *Cookie) SetTypes() {
+	x.DType = []string{"Cookie"}
+	for i := range x.Browsers {
+		x.Browsers[i].SetTypes()
+	}
+	for i := range x.Partners {
+		x.Partners[i].DType = []string{"Partner"}
+	}
+}
+
+func (x *Browser) SetTypes() {
+	x.DType = []string{"Browser"}
+	for i := range x.Enrichments {
+		x.Enrichments[i].DType = []string{"Enrichment"}
+	}
+}
+
+// Clear the internal node ids and types before a cookie leaves the system.
+func (x *Cookie) Redact() {
+	x.Uid = ""
+	x.DType = nil
+	for i := range x.Browsers {
+		b := &x.Browsers[i]
+		b.Uid = ""
+		b.DType = nil
+		for j := range b.Enrichments {
+			b.Enrichments[j].Uid = ""
+			b.Enrichments[j].DType = nil
+		}
+	}
+	for i := range x.Partners {
+		x.Partners[i].Uid = ""
+		x.Partners[i].DType = nil
+	}
+}
+
+func (x *Browser) SetUserAgent(ua UserAgent) {
+	x.BrowserFamily = ua.BrowserFamily
+	x.BrowserVersion = ua.BrowserVersion
+	x.BrowserMajor = ua.BrowserMajor()
+	x.OSFamily = ua.OSFamily
+	x.OSVersion = ua.OSVersion
+	x.DeviceType = ua.DeviceType
+	x.DeviceVendor = ua.DeviceVendor
+}
+
+func (x *Browser) ParsedUserAgent() UserAgent {
+	return UserAgent{
+		BrowserFamily:  x.BrowserFamily,
+		BrowserVersion: x.BrowserVersion,
+		OSFamily:       x.OSFamily,
+		OSVersion:      x.OSVersion,
+		DeviceType:     x.DeviceType,
+		DeviceVendor:   x.DeviceVendor}
+}
+
+func (x *Cookie) HasBrowser(browser Browser) bool {
+	for _, b := range x.Browsers {
+		if b.UserAgent == browser.UserAgent && b.Addr == browser.Addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *Cookie) HasPartner(partner Partner) bool {
+	for _, p := range x.Partners {
+		if p.PartnerID == partner.PartnerID && p.CookieID == partner.CookieID {
+			return true
+		}
+	}
+	return false
+}
+
 func (x *Dgraph) NewTxn() *dgo.Txn {
 	return x.dg.NewTxn()
 }
 
-func (x *Dgraph) FindCookie(ctx context.Context, txn *dgo.Txn, cookie string) (*Cookie, error) {
-
+// Run a lookup in the caller's txn, where it sees the caller's writes, or without one in a
+// read-only best-effort txn of its own that is discarded on return.  Each lookup gets its own
+// deadline.
+func (x *Dgraph) query(ctx context.Context, txn *dgo.Txn, query string, vars map[string]string) (*api.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, x.queryTimeout)
+	defer cancel()
 	if txn == nil {
-		txn = x.dg.NewTxn()
+		txn = x.dg.NewReadOnlyTxn().BestEffort()
+		defer txn.Discard(ctx)
 	}
+	return txn.QueryWithVars(ctx, query, vars)
+}
+
+func (x *Dgraph) FindCookie(ctx context.Context, txn *dgo.Txn, cookie string) (*Cookie, error) {
+
 	vars := map[string]string{"$cookie": cookie}
 	query := `query all($cookie: string) {
-		all(func: eq(cookie, $cookie)) {
-			uid
-			cookie
-			issued
-			browser {
-				uid
-				addr
-				useragent
-				count
-			}
-			partner {
-				uid
-				pid
-				pcookie
-			}
-		}
+		all(func: eq(cookie, $cookie)) {` + COOKIE_FIELDS + `}
 	}
 	`
-	resp, err := txn.QueryWithVars(ctx, query, vars)
-	//resp, err := txn.Query(ctx, query)
+	resp, err := x.query(ctx, txn, query, vars)
 	if err != nil {
 		log.Error().Err(err).Str("component", "dgraph").Msg("find cookie")
 		return nil, err
@@ -232,23 +483,14 @@ func (x *Dgraph) FindCookie(ctx context.Context, txn *dgo.Txn, cookie string) (*
 
 func (x *Dgraph) FindBrowser(ctx context.Context, txn *dgo.Txn, ua string, ip string) (*Browser, error) {
 
-	if txn == nil {
-		txn = x.dg.NewTxn()
-	}
 	vars := make(map[string]string)
 	vars["$ua"] = ua
 	vars["$ip"] = ip
 	query := `query all($ua: string, $ip: string) {
-		all(func: eq(useragent, $ua)) @filter(eq(addr, $ip)) {
-			uid
-			addr
-			useragent
-			count
-		}
+		all(func: eq(useragent, $ua)) @filter(eq(addr, $ip) AND NOT has(anonymizer)) {` + BROWSER_FIELDS + `}
 	}
 	`
-	resp, err := txn.QueryWithVars(ctx, query, vars)
-	//resp, err := txn.Query(ctx, query)
+	resp, err := x.query(ctx, txn, query, vars)
 	if err != nil {
 		log.Error().Err(err).Str("component", "dgraph").Msg("find cookie")
 		return nil, err
@@ -256,25 +498,46 @@ func (x *Dgraph) FindBrowser(ctx context.Context, txn *dgo.Txn, ua string, ip st
 	return x.returnBrowser(resp.Json)
 }
 
-func (x *Dgraph) FindBrowserByUid(ctx context.Context, txn *dgo.Txn, uid string) (*Browser, error) {
+// Match a browser on the same address by browser and OS family, within tolerance major versions.
+func (x *Dgraph) FindBrowserByFamily(ctx context.Context, txn *dgo.Txn, ip string, family string, os string, major int) (*Browser, error) {
+
+	vars := map[string]string{
+		"$ip":     ip,
+		"$family": family,
+		"$os":     os,
+		"$min":    strconv.Itoa(major - x.tolerance),
+		"$max":    strconv.Itoa(major + x.tolerance)}
+	query := `query all($ip: string, $family: string, $os: string, $min: int, $max: int) {
+		all(func: eq(addr, $ip), orderdesc: browser_major) @filter(eq(browser_family, $family) AND eq(os_family, $os) AND ge(browser_major, $min) AND le(browser_major, $max) AND NOT has(anonymizer)) {` + BROWSER_FIELDS + `}
+	}
+	`
+	resp, err := x.query(ctx, txn, query, vars)
+	if err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Msg("find browser by family")
+		return nil, err
+	}
+	return x.returnBrowser(resp.Json)
+}
 
-	if txn == nil {
-		txn = x.dg.NewTxn()
+// The browser another cookie already created for this one, by exact (ua, ip) and then by family.
+func (x *Dgraph) findSimilarBrowser(ctx context.Context, txn *dgo.Txn, browser Browser) (*Browser, error) {
+	existing, err := x.FindBrowser(ctx, txn, browser.UserAgent, browser.Addr)
+	if err == ErrBrowserNotFound && browser.BrowserFamily != "" && browser.OSFamily != "" && x.tolerance >= 0 {
+		return x.FindBrowserByFamily(ctx, txn, browser.Addr, browser.BrowserFamily, browser.OSFamily, browser.BrowserMajor)
 	}
+	return existing, err
+}
+
+func (x *Dgraph) FindBrowserByUid(ctx context.Context, txn *dgo.Txn, uid string) (*Browser, error) {
 
 	vars := map[string]string{"$uid": uid}
 	query := `
 		query browsers($uid: string) {
-			all(func: uid($uid)) {
-				uid
-				addr
-				useragent
-				count
-			}
+			all(func: uid($uid)) {` + BROWSER_FIELDS + `}
 		}
 		`
 
-	resp, err := txn.QueryWithVars(ctx, query, vars)
+	resp, err := x.query(ctx, txn, query, vars)
 	if err != nil {
 		log.Error().Err(err).Str("component", "dgraph").Msg("find browser with uid")
 		return nil, err
@@ -284,33 +547,14 @@ func (x *Dgraph) FindBrowserByUid(ctx context.Context, txn *dgo.Txn, uid string)
 
 func (x *Dgraph) FindCookieByUid(ctx context.Context, txn *dgo.Txn, uid string) (*Cookie, error) {
 
-	if txn == nil {
-		txn = x.dg.NewTxn()
-	}
-
 	vars := map[string]string{"$uid": uid}
 	query := `
 		query cookies($uid: string) {
-			all(func: uid($uid)) {
-				uid
-				cookie
-				issued
-				browser {
-					uid
-					addr
-					useragent
-					count
-				}
-				partner {
-					uid
-					pid
-					pcookie
-				}
-			}
+			all(func: uid($uid)) {` + COOKIE_FIELDS + `}
 		}
 		`
 
-	resp, err := txn.QueryWithVars(ctx, query, vars)
+	resp, err := x.query(ctx, txn, query, vars)
 	if err != nil {
 		log.Error().Err(err).Str("component", "dgraph").Msg("find cookie with uid")
 		return nil, err
@@ -318,6 +562,81 @@ func (x *Dgraph) FindCookieByUid(ctx context.Context, txn *dgo.Txn, uid string)
 	return x.returnCookie(resp.Json)
 }
 
+// The cookie ids sharing a browser or a partner cookie id with cookieID, walked hop by hop.
+func (x *Dgraph) FindCluster(ctx context.Context, cookieID string) ([]string, error) {
+	// one snapshot for every hop, each hop with its own deadline
+	txn := x.dg.NewReadOnlyTxn().BestEffort()
+	defer txn.Discard(ctx)
+
+	query := `query all($cookie: string) {
+		all(func: eq(cookie, $cookie)) {
+			browser { ~browser { cookie } }
+			partner { pid pcookie }
+		}
+	}`
+	// partner cookie ids are only unique within the partner, one that is missing links nothing
+	byPartner := `query all($pcookie: string) {
+		all(func: eq(pcookie, $pcookie)) { pid ~partner { cookie } }
+	}`
+	return resolveCluster(cookieID, func(id string) ([]string, error) {
+		resp, err := x.query(ctx, txn, query, map[string]string{"$cookie": id})
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Msg("find cluster")
+			return nil, err
+		}
+		var data struct {
+			All []struct {
+				Browsers []struct {
+					Cookies []Cookie `json:"~browser"`
+				} `json:"browser"`
+				Partners []Partner `json:"partner"`
+			} `json:"all"`
+		}
+		if err := json.Unmarshal(resp.Json, &data); err != nil {
+			return nil, err
+		}
+		if len(data.All) == 0 {
+			return nil, ErrCookieNotFound
+		}
+		ids := []string{}
+		for _, cookie := range data.All {
+			for _, b := range cookie.Browsers {
+				for _, other := range b.Cookies {
+					ids = append(ids, other.CookieID)
+				}
+			}
+			for _, p := range cookie.Partners {
+				if p.CookieID == "" {
+					continue
+				}
+				resp, err := x.query(ctx, txn, byPartner, map[string]string{"$pcookie": p.CookieID})
+				if err != nil {
+					log.Error().Err(err).Str("component", "dgraph").Msg("find cluster")
+					return nil, err
+				}
+				var others struct {
+					All []struct {
+						PartnerID string   `json:"pid"`
+						Cookies   []Cookie `json:"~partner"`
+					} `json:"all"`
+				}
+				if err := json.Unmarshal(resp.Json, &others); err != nil {
+					return nil, err
+				}
+				for _, other := range others.All {
+					if other.PartnerID != p.PartnerID {
+						continue
+					}
+					for _, c := range other.Cookies {
+						ids = append(ids, c.CookieID)
+					}
+				}
+			}
+		}
+		return ids, nil
+	})
+}
+
 func (x *Dgraph) returnCookie(resp []byte) (*Cookie, error) {
 
 	log.Debug().Str("component", "dgraph").Str("json", string(resp)).Msg("result cookie")
@@ -334,6 +653,7 @@ func (x *Dgraph) returnCookie(resp []byte) (*Cookie, error) {
 	}
 
 	if len(data.All) > 1 {
+		sort.SliceStable(data.All, func(i, j int) bool { return canonicalLess(&data.All[i], &data.All[j]) })
 		return &data.All[0], ErrDuplicateCookiesExist
 	}
 
@@ -352,7 +672,7 @@ func (x *Dgraph) returnBrowser(resp []byte) (*Browser, error) {
 	}
 
 	if len(data.All) == 0 {
-		return nil, ErrCookieNotFound
+		return nil, ErrBrowserNotFound
 	}
 
 	return &data.All[0], nil
@@ -0,0 +1,150 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	api "github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	DGRAPH_TIMEOUT       = 10 * time.Second
+	DGRAPH_QUERY_TIMEOUT = 2 * time.Second
+)
+
+var ErrNoDgraphEndpoints = errors.New("no dgraph endpoints, set DGRAPH_SVR")
+var ErrDgraphCA = errors.New("no certificates in the dgraph CA file")
+var ErrDgraphCredentials = errors.New("DGRAPH_ACL needs DGRAPH_USER and DGRAPH_PASS")
+
+// Dial every Alpha in DgraphSvrs, each request goes to one of them at random, and log in when
+// ACLs are on.  The connections stay open until Close.
+func NewDgraph(cfg ServerConfig) (*Dgraph, error) {
+	if len(cfg.DgraphSvrs) == 0 {
+		return nil, ErrNoDgraphEndpoints
+	}
+	if cfg.DgraphACL && (cfg.DgraphUser == "" || cfg.DgraphPass == "") {
+		return nil, ErrDgraphCredentials
+	}
+	transport, err := dgraphTransport(cfg)
+	if err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Msg("tls")
+		return nil, err
+	}
+
+	x := &Dgraph{
+		tolerance:     cfg.UAVersionTolerance,
+		retryDeadline: cfg.DgraphRetryDeadline,
+		queryTimeout:  cfg.DgraphQueryTimeout,
+		writeTimeout:  cfg.DgraphWriteTimeout,
+		stop:          make(chan struct{})}
+	if x.queryTimeout <= 0 {
+		x.queryTimeout = DGRAPH_QUERY_TIMEOUT
+	}
+	if x.writeTimeout <= 0 {
+		x.writeTimeout = DGRAPH_TIMEOUT
+	}
+	clients := []api.DgraphClient{}
+	for _, addr := range cfg.DgraphSvrs {
+		conn, err := grpc.Dial(addr, transport)
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("addr", addr).Msg("connect")
+			x.Close()
+			return nil, err
+		}
+		x.conns = append(x.conns, conn)
+		clients = append(clients, api.NewDgraphClient(conn))
+	}
+	x.dg = dgo.NewDgraphClient(clients...)
+
+	if cfg.DgraphACL {
+		if err := x.login(cfg); err != nil {
+			x.Close()
+			return nil, err
+		}
+		x.refreshLogin(cfg)
+	}
+	return x, nil
+}
+
+// Plaintext unless DgraphTLS, the CA verifies the Alphas and a client pair turns on mutual TLS.
+func dgraphTransport(cfg ServerConfig) (grpc.DialOption, error) {
+	if !cfg.DgraphTLS {
+		return grpc.WithInsecure(), nil
+	}
+	config := &tls.Config{ServerName: cfg.DgraphServerName, MinVersion: tls.VersionTLS12}
+	if cfg.DgraphCACert != "" {
+		pem, err := os.ReadFile(cfg.DgraphCACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrDgraphCA
+		}
+	}
+	if cfg.DgraphClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.DgraphClientCert, cfg.DgraphClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+func (x *Dgraph) login(cfg ServerConfig) error {
+	timeout := cfg.DgraphTimeout
+	if timeout <= 0 {
+		timeout = DGRAPH_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := x.dg.Login(ctx, cfg.DgraphUser, cfg.DgraphPass); err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Str("user", cfg.DgraphUser).Msg("login")
+		return err
+	}
+	return nil
+}
+
+// dgo trades the refresh token for a new access token when one expires, logging in again on the
+// interval keeps the refresh token from running out as well.
+func (x *Dgraph) refreshLogin(cfg ServerConfig) {
+	if cfg.DgraphLoginRefresh <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.DgraphLoginRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				x.login(cfg)
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the login refresh and close every connection.
+func (x *Dgraph) Close() error {
+	var err error
+	x.once.Do(func() {
+		close(x.stop)
+		for _, conn := range x.conns {
+			if cerr := conn.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"strconv"
+	"time"
+)
+
+// attribute value types, the graph stores every value as a string
+const (
+	ATTR_STRING = "string"
+	ATTR_INT    = "int"
+	ATTR_FLOAT  = "float"
+	ATTR_BOOL   = "bool"
+)
+
+// One typed fact produced by an enricher.
+type Attribute struct {
+	Key   string `json:"attribute"`
+	Type  string `json:"value_type"`
+	Value string `json:"value"`
+}
+
+// An attribute with its provenance, stored as an Enrichment node hanging off the Browser.
+type Enrichment struct {
+	Uid      string    `json:"uid,omitempty"`
+	Enricher string    `json:"enricher"`
+	At       time.Time `json:"enriched_at"`
+	Attribute
+	DType []string `json:"dgraph.type,omitempty"`
+}
+
+const ENRICHMENT_FIELDS = `
+	uid
+	enricher
+	enriched_at
+	attribute
+	value_type
+	value
+`
+
+func StringAttr(key string, value string) Attribute {
+	return Attribute{Key: key, Type: ATTR_STRING, Value: value}
+}
+
+func IntAttr(key string, value int64) Attribute {
+	return Attribute{Key: key, Type: ATTR_INT, Value: strconv.FormatInt(value, 10)}
+}
+
+func FloatAttr(key string, value float64) Attribute {
+	return Attribute{Key: key, Type: ATTR_FLOAT, Value: strconv.FormatFloat(value, 'g', -1, 64)}
+}
+
+func BoolAttr(key string, value bool) Attribute {
+	return Attribute{Key: key, Type: ATTR_BOOL, Value: strconv.FormatBool(value)}
+}
+
+// The value converted back to its declared type.
+func (x Attribute) Typed() (interface{}, error) {
+	switch x.Type {
+	case ATTR_INT:
+		return strconv.ParseInt(x.Value, 10, 64)
+	case ATTR_FLOAT:
+		return strconv.ParseFloat(x.Value, 64)
+	case ATTR_BOOL:
+		return strconv.ParseBool(x.Value)
+	}
+	return x.Value, nil
+}
+
+// Add fresh enrichments, reusing the node of an older result from the same enricher and attribute.
+func (x *Browser) MergeEnrichments(fresh []Enrichment) {
+	for _, e := range fresh {
+		replaced := false
+		for i, old := range x.Enrichments {
+			if old.Enricher == e.Enricher && old.Key == e.Key {
+				e.Uid = old.Uid
+				x.Enrichments[i] = e
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			x.Enrichments = append(x.Enrichments, e)
+		}
+	}
+}
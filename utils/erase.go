@@ -0,0 +1,176 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	api "github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/rs/zerolog/log"
+)
+
+// A node removed by an erasure.
+type ErasedNode struct {
+	Type string `json:"type"`
+	Uid  string `json:"uid"`
+}
+
+// What an erasure removed, kept by the caller as evidence the request was honoured.
+type ErasureReceipt struct {
+	Subject      string       `json:"subject"`
+	RequestedAt  time.Time    `json:"requested_at"`
+	CompletedAt  time.Time    `json:"completed_at"`
+	CookieIDs    []string     `json:"cookie_ids"`
+	Nodes        []ErasedNode `json:"nodes"`
+	CacheEntries []string     `json:"cache_entries"`
+}
+
+type erasureNode struct {
+	Uid         string        `json:"uid"`
+	Seen        *time.Time    `json:"seen,omitempty"`
+	Enrichments []erasureNode `json:"enrichment"`
+	Browsers    []erasureNode `json:"browser"`
+	Partners    []erasureNode `json:"partner"`
+	Cookies     []erasureNode `json:"~browser"`
+	Owners      []erasureNode `json:"~partner"`
+}
+
+// Delete every cookie node with this id, plus the browsers, partners and enrichments that no
+// other cookie links to.  Shared browsers keep existing and only lose the edge.
+func (x *Dgraph) EraseCookie(ctx context.Context, cookieID string) ([]ErasedNode, error) {
+	var erased *erasure
+	err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		query := `query all($cookie: string) {
+			all(func: eq(cookie, $cookie)) {
+				uid
+				browser {
+					uid
+					enrichment { uid }
+					~browser { uid }
+				}
+				partner {
+					uid
+					~partner { uid }
+				}
+			}
+		}`
+		resp, err := x.query(ctx, txn, query, map[string]string{"$cookie": cookieID})
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "erase").Msg("query")
+			return err
+		}
+		var data struct {
+			All []erasureNode `json:"all"`
+		}
+		if err := json.Unmarshal(resp.Json, &data); err != nil {
+			return err
+		}
+		if len(data.All) == 0 {
+			return ErrCookieNotFound
+		}
+
+		erasing := map[string]bool{}
+		for _, cookie := range data.All {
+			erasing[cookie.Uid] = true
+		}
+		orphaned := func(owners []erasureNode) bool {
+			for _, owner := range owners {
+				if !erasing[owner.Uid] {
+					return false
+				}
+			}
+			return true
+		}
+
+		erased = &erasure{seen: map[string]bool{}}
+		for _, cookie := range data.All {
+			erased.add("Cookie", cookie.Uid)
+			for _, browser := range cookie.Browsers {
+				if orphaned(browser.Cookies) {
+					erased.browser(browser)
+				}
+			}
+			for _, partner := range cookie.Partners {
+				if orphaned(partner.Owners) {
+					erased.add("Partner", partner.Uid)
+				}
+			}
+		}
+
+		if err := deleteNodes(ctx, txn, erased.nodes, false); err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "erase").Msg("mutate")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return erased.nodes, nil
+}
+
+// Nodes picked for deletion, each once.
+type erasure struct {
+	nodes []ErasedNode
+	seen  map[string]bool
+}
+
+func (x *erasure) add(typ, uid string) {
+	if !x.seen[uid] {
+		x.seen[uid] = true
+		x.nodes = append(x.nodes, ErasedNode{Type: typ, Uid: uid})
+	}
+}
+
+// A browser goes with its enrichments, nothing else points at them.
+func (x *erasure) browser(browser erasureNode) {
+	x.add("Browser", browser.Uid)
+	for _, enrichment := range browser.Enrichments {
+		x.add("Enrichment", enrichment.Uid)
+	}
+}
+
+// {"uid": X} deletes every predicate of X's dgraph.type, which is why nodes must be typed
+func deleteNodes(ctx context.Context, txn *dgo.Txn, nodes []ErasedNode, commitNow bool) error {
+	deletes := make([]map[string]string, 0, len(nodes))
+	for _, node := range nodes {
+		deletes = append(deletes, map[string]string{"uid": node.Uid})
+	}
+	pb, err := json.Marshal(deletes)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: pb, CommitNow: commitNow})
+	return err
+}
+
+// Our cookie ids linked to a partner's cookie id.
+func (x *Dgraph) FindCookieIDsByPartner(ctx context.Context, partnerCookieID string) ([]string, error) {
+	query := `query all($pcookie: string) {
+		all(func: eq(pcookie, $pcookie)) {
+			~partner { cookie }
+		}
+	}`
+	resp, err := x.query(ctx, nil, query, map[string]string{"$pcookie": partnerCookieID})
+	if err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Msg("find cookies by partner")
+		return nil, err
+	}
+	var data struct {
+		All []struct {
+			Cookies []Cookie `json:"~partner"`
+		} `json:"all"`
+	}
+	if err := json.Unmarshal(resp.Json, &data); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, partner := range data.All {
+		for _, cookie := range partner.Cookies {
+			ids = append(ids, cookie.CookieID)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,109 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	api "github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/rs/zerolog/log"
+)
+
+const EXPORT_BATCH = 500
+
+// The write that brings an exported cookie back: fresh nodes except for browsers the store already
+// holds, every edge with its facets as exported.
+func restoreUpdate(cookie Cookie, find func(Browser) (*Browser, error)) (*Cookie, error) {
+	update := cookie
+	update.Uid = "_:cookie"
+	// exports from before seen was tracked age out from when the cookie was issued, or from now
+	if update.SeenAt == nil {
+		update.SeenAt = update.IssuedAt
+	}
+	if update.SeenAt == nil {
+		now := time.Now()
+		update.SeenAt = &now
+	}
+	update.Browsers = nil
+	update.Partners = nil
+	for i, b := range cookie.Browsers {
+		b.Uid = fmt.Sprintf("_:browser%d", i)
+		b.Enrichments = append([]Enrichment(nil), b.Enrichments...)
+		for j := range b.Enrichments {
+			b.Enrichments[j].Uid = ""
+		}
+		// an anonymizer address is shared by strangers, never link through it
+		if b.Anonymizer == "" {
+			existing, err := find(b)
+			if err == nil {
+				existing.FirstSeen, existing.LastSeen, existing.Hits, existing.Source = b.FirstSeen, b.LastSeen, b.Hits, b.Source
+				b = *existing
+			} else if err != ErrBrowserNotFound {
+				return nil, err
+			}
+		}
+		update.Browsers = append(update.Browsers, b)
+	}
+	for i, p := range cookie.Partners {
+		p.Uid = fmt.Sprintf("_:partner%d", i)
+		update.Partners = append(update.Partners, p)
+	}
+	return &update, nil
+}
+
+// A page of cookies in uid order, after "" starts from the first.
+func (x *Dgraph) ScanCookies(ctx context.Context, after string, limit int) ([]Cookie, error) {
+	if after == "" {
+		after = "0x0"
+	}
+	query := fmt.Sprintf(`{ all(func: type(Cookie), first: %d, after: %s) { %s } }`, limit, after, COOKIE_FIELDS)
+	resp, err := x.query(ctx, nil, query, nil)
+	if err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Msg("scan cookies")
+		return nil, err
+	}
+	var data CookieResponse
+	if err := json.Unmarshal(resp.Json, &data); err != nil {
+		return nil, err
+	}
+	return data.All, nil
+}
+
+// Write an exported cookie back, ErrCookieExists when the id is already in the graph.
+func (x *Dgraph) RestoreCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	var update *Cookie
+	err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		if _, err := x.FindCookie(ctx, txn, cookie.CookieID); err != ErrCookieNotFound {
+			if err == nil || err == ErrDuplicateCookiesExist {
+				return ErrCookieExists
+			}
+			return err
+		}
+		var err error
+		update, err = restoreUpdate(cookie, func(b Browser) (*Browser, error) {
+			return x.findSimilarBrowser(ctx, txn, b)
+		})
+		if err != nil {
+			return err
+		}
+		update.SetTypes()
+		pb, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		resp, err := txn.Mutate(ctx, &api.Mutation{SetJson: pb})
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "restore").Msg("mutate")
+			return err
+		}
+		update.Uid = resp.GetUids()["cookie"]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
@@ -0,0 +1,180 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+)
+
+const GEO_LANGUAGE = "en"
+
+// Where an address is, flattened onto the Browser node.
+type Geo struct {
+	Country string `json:"geo_country,omitempty"`
+	Region  string `json:"geo_region,omitempty"`
+	City    string `json:"geo_city,omitempty"`
+	ASN     uint   `json:"geo_asn,omitempty"`
+	Org     string `json:"geo_org,omitempty"`
+}
+
+// covers the City, Country, ASN and combined MaxMind layouts
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+type geoDB struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+// Looks addresses up in one or more local MMDB files, e.g. a City and an ASN database, and
+// reopens a file when its modification time changes.
+type GeoIP struct {
+	mu   sync.RWMutex
+	dbs  []*geoDB
+	stop chan struct{}
+	once sync.Once
+}
+
+// Open every file that exists, missing files are skipped so the ASN database stays optional.
+func NewGeoIP(files []string) *GeoIP {
+	x := &GeoIP{stop: make(chan struct{})}
+	for _, file := range files {
+		db := &geoDB{path: file}
+		if err := db.open(); err != nil {
+			log.Warn().Err(err).Str("component", "geoip").Str("path", file).Msg("open")
+		}
+		x.dbs = append(x.dbs, db)
+	}
+	return x
+}
+
+func (x *GeoIP) Lookup(clientIP string) (Geo, bool) {
+	var geo Geo
+	ip := net.ParseIP(strings.TrimSpace(strings.Split(clientIP, ",")[0]))
+	if ip == nil {
+		return geo, false
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	found := false
+	for _, db := range x.dbs {
+		if db.reader == nil {
+			continue
+		}
+		var record geoRecord
+		if err := db.reader.Lookup(ip, &record); err != nil {
+			log.Warn().Err(err).Str("component", "geoip").Str("path", db.path).Msg("lookup")
+			continue
+		}
+		found = geo.merge(record) || found
+	}
+	return geo, found
+}
+
+// Reopen any database whose file changed since it was loaded.
+func (x *GeoIP) Reload() {
+	for _, db := range x.dbs {
+		info, err := os.Stat(db.path)
+		if err != nil || !info.ModTime().After(db.modTime) {
+			continue
+		}
+		next := &geoDB{path: db.path}
+		if err := next.open(); err != nil {
+			log.Error().Err(err).Str("component", "geoip").Str("path", db.path).Msg("reload")
+			continue
+		}
+		x.mu.Lock()
+		old := db.reader
+		db.reader, db.modTime = next.reader, next.modTime
+		x.mu.Unlock()
+		if old != nil {
+			old.Close()
+		}
+		log.Info().Str("component", "geoip").Str("path", db.path).Msg("reloaded")
+	}
+}
+
+// Check the files every interval until Close.
+func (x *GeoIP) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				x.Reload()
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *GeoIP) Close() {
+	x.once.Do(func() { close(x.stop) })
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, db := range x.dbs {
+		if db.reader != nil {
+			db.reader.Close()
+			db.reader = nil
+		}
+	}
+}
+
+func (x *geoDB) open() error {
+	info, err := os.Stat(x.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.Open(x.path)
+	if err != nil {
+		return err
+	}
+	x.reader = reader
+	x.modTime = info.ModTime()
+	return nil
+}
+
+// Fill the blanks from one database record, reports whether it added anything.
+func (x *Geo) merge(record geoRecord) bool {
+	before := *x
+	if x.Country == "" {
+		x.Country = record.Country.ISOCode
+	}
+	if x.Region == "" && len(record.Subdivisions) > 0 {
+		x.Region = record.Subdivisions[0].ISOCode
+	}
+	if x.City == "" {
+		x.City = record.City.Names[GEO_LANGUAGE]
+	}
+	if x.ASN == 0 {
+		x.ASN = record.ASN
+	}
+	if x.Org == "" {
+		x.Org = record.Org
+	}
+	return *x != before
+}
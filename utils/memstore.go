@@ -0,0 +1,455 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdentityStore held in memory with the graph's semantics: browser and partner nodes are shared
+// between cookies, the edges carry the facets and uids are handed out in ascending order.
+type MemoryStore struct {
+	mu        sync.Mutex
+	tolerance int
+	next      uint64
+	cookies   map[string]*Cookie // edges only hold the uid and facets
+	browsers  map[string]Browser // node data, no facets
+	partners  map[string]Partner
+}
+
+func NewMemoryStore(tolerance int) *MemoryStore {
+	return &MemoryStore{
+		tolerance: tolerance,
+		cookies:   map[string]*Cookie{},
+		browsers:  map[string]Browser{},
+		partners:  map[string]Partner{}}
+}
+
+func (x *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (x *MemoryStore) CreateCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, err := x.findCookie(cookie.CookieID); err != ErrCookieNotFound {
+		return nil, ErrCookieExists
+	}
+	// seen drives retention, a cookie that never syncs still ages out from when it was issued
+	createdAt := time.Now()
+	cookie.IssuedAt = &createdAt
+	cookie.SeenAt = &createdAt
+	cookie.Uid = "_:cookie"
+	uid := x.write(cookie)
+	return x.assemble(x.cookies[uid]), nil
+}
+
+func (x *MemoryStore) FindCookie(ctx context.Context, cookieID string) (*Cookie, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.findCookie(cookieID)
+}
+
+func (x *MemoryStore) FindBrowser(ctx context.Context, ua string, ip string) (*Browser, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.findBrowser(func(b Browser) bool {
+		return b.UserAgent == ua && b.Addr == ip && b.Anonymizer == ""
+	})
+}
+
+func (x *MemoryStore) FindCookieIDsByPartner(ctx context.Context, partnerCookieID string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ids := []string{}
+	for _, cookie := range x.sortedCookies() {
+		for _, p := range cookie.Partners {
+			if x.partners[p.Uid].CookieID == partnerCookieID {
+				ids = append(ids, cookie.CookieID)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (x *MemoryStore) LinkCookie(ctx context.Context, cookieID string, browser Browser, partner Partner, tags []string) (*Cookie, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	now := time.Now()
+	cookie, err := x.findCookie(cookieID)
+	if err == ErrCookieNotFound {
+		cookie = &Cookie{Uid: "_:cookie", CookieID: cookieID, IssuedAt: &now}
+	} else if err != nil && err != ErrDuplicateCookiesExist {
+		return nil, err
+	}
+	update, err := linkUpdate(cookie, browser, partner, tags, now, x.findSimilarBrowser)
+	if err != nil {
+		return nil, err
+	}
+	update.Uid = x.write(*update)
+	return update, nil
+}
+
+func (x *MemoryStore) MergeCookies(ctx context.Context, into string, from string) (*Cookie, error) {
+	if into == from {
+		return nil, ErrMergeSelf
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	target, err := x.findCookie(into)
+	if err != nil && err != ErrDuplicateCookiesExist {
+		return nil, err
+	}
+	source, err := x.findCookie(from)
+	if err != nil && err != ErrDuplicateCookiesExist {
+		return nil, err
+	}
+	target.Merge(*source)
+	x.write(*target)
+	delete(x.cookies, source.Uid)
+	return target, nil
+}
+
+func (x *MemoryStore) EraseCookie(ctx context.Context, cookieID string) ([]ErasedNode, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	erasing := map[string]bool{}
+	for _, cookie := range x.sortedCookies() {
+		if cookie.CookieID == cookieID {
+			erasing[cookie.Uid] = true
+		}
+	}
+	if len(erasing) == 0 {
+		return nil, ErrCookieNotFound
+	}
+	// a node is orphaned once every cookie linking to it is being erased
+	orphaned := func(uid string, browser bool) bool {
+		for _, cookie := range x.cookies {
+			if erasing[cookie.Uid] {
+				continue
+			}
+			if browser && cookie.browserEdge(uid) >= 0 || !browser && cookie.partnerEdge(uid) >= 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	erased := &erasure{seen: map[string]bool{}}
+	for _, cookie := range x.sortedCookies() {
+		if !erasing[cookie.Uid] {
+			continue
+		}
+		erased.add("Cookie", cookie.Uid)
+		for _, b := range cookie.Browsers {
+			if orphaned(b.Uid, true) {
+				erased.add("Browser", b.Uid)
+				for _, e := range x.browsers[b.Uid].Enrichments {
+					erased.add("Enrichment", e.Uid)
+				}
+			}
+		}
+		for _, p := range cookie.Partners {
+			if orphaned(p.Uid, false) {
+				erased.add("Partner", p.Uid)
+			}
+		}
+	}
+	for _, node := range erased.nodes {
+		switch node.Type {
+		case "Cookie":
+			delete(x.cookies, node.Uid)
+		case "Browser":
+			delete(x.browsers, node.Uid)
+		case "Partner":
+			delete(x.partners, node.Uid)
+		}
+	}
+	return erased.nodes, nil
+}
+
+func (x *MemoryStore) FindCluster(ctx context.Context, cookieID string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return resolveCluster(cookieID, func(id string) ([]string, error) {
+		cookie, err := x.findCookie(id)
+		if err != nil && err != ErrDuplicateCookiesExist {
+			return nil, err
+		}
+		ids := []string{}
+		for _, other := range x.sortedCookies() {
+			linked := false
+			for _, b := range cookie.Browsers {
+				linked = linked || other.browserEdge(b.Uid) >= 0
+			}
+			for _, p := range cookie.Partners {
+				for _, op := range other.Partners {
+					theirs := x.partners[op.Uid]
+					linked = linked || (p.CookieID != "" && theirs.PartnerID == p.PartnerID && theirs.CookieID == p.CookieID)
+				}
+			}
+			if linked {
+				ids = append(ids, other.CookieID)
+			}
+		}
+		return ids, nil
+	})
+}
+
+func (x *MemoryStore) FindDuplicateCookieIDs(ctx context.Context, limit int) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	counts := map[string]int{}
+	ids := []string{}
+	for _, cookie := range x.sortedCookies() {
+		counts[cookie.CookieID]++
+		if counts[cookie.CookieID] == 2 && (limit <= 0 || len(ids) < limit) {
+			ids = append(ids, cookie.CookieID)
+		}
+	}
+	return ids, nil
+}
+
+func (x *MemoryStore) ReconcileCookie(ctx context.Context, cookieID string) (*ReconcileRecord, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	nodes := []*Cookie{}
+	for _, cookie := range x.sortedCookies() {
+		if cookie.CookieID == cookieID {
+			nodes = append(nodes, cookie)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, ErrCookieNotFound
+	}
+	if len(nodes) == 1 {
+		return nil, nil
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return canonicalLess(nodes[i], nodes[j]) })
+	canonical := x.assemble(nodes[0])
+	merged := []string{}
+	for _, node := range nodes[1:] {
+		canonical.Merge(*x.assemble(node))
+		merged = append(merged, node.Uid)
+		delete(x.cookies, node.Uid)
+	}
+	x.write(*canonical)
+	return newReconcileRecord(canonical, merged), nil
+}
+
+func (x *MemoryStore) ScanCookies(ctx context.Context, after string, limit int) ([]Cookie, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	cookies := []Cookie{}
+	for _, cookie := range x.sortedCookies() {
+		if uidValue(cookie.Uid) > uidValue(after) && len(cookies) < limit {
+			cookies = append(cookies, *x.assemble(cookie))
+		}
+	}
+	return cookies, nil
+}
+
+func (x *MemoryStore) RestoreCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, err := x.findCookie(cookie.CookieID); err != ErrCookieNotFound {
+		return nil, ErrCookieExists
+	}
+	update, err := restoreUpdate(cookie, x.findSimilarBrowser)
+	if err != nil {
+		return nil, err
+	}
+	uid := x.write(*update)
+	return x.assemble(x.cookies[uid]), nil
+}
+
+func (x *MemoryStore) findCookie(cookieID string) (*Cookie, error) {
+	found := []*Cookie{}
+	for _, cookie := range x.sortedCookies() {
+		if cookie.CookieID == cookieID {
+			found = append(found, x.assemble(cookie))
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrCookieNotFound
+	}
+	if len(found) > 1 {
+		sort.SliceStable(found, func(i, j int) bool { return canonicalLess(found[i], found[j]) })
+		return found[0], ErrDuplicateCookiesExist
+	}
+	return found[0], nil
+}
+
+func (x *MemoryStore) findSimilarBrowser(browser Browser) (*Browser, error) {
+	existing, err := x.findBrowser(func(b Browser) bool {
+		return b.UserAgent == browser.UserAgent && b.Addr == browser.Addr && b.Anonymizer == ""
+	})
+	if err != ErrBrowserNotFound || browser.BrowserFamily == "" || browser.OSFamily == "" || x.tolerance < 0 {
+		return existing, err
+	}
+	// newest major first, as the graph orders it
+	var best *Browser
+	for _, b := range x.sortedBrowsers() {
+		if b.Addr != browser.Addr || b.BrowserFamily != browser.BrowserFamily || b.OSFamily != browser.OSFamily || b.Anonymizer != "" {
+			continue
+		}
+		if b.BrowserMajor < browser.BrowserMajor-x.tolerance || b.BrowserMajor > browser.BrowserMajor+x.tolerance {
+			continue
+		}
+		if best == nil || b.BrowserMajor > best.BrowserMajor {
+			best = copyBrowser(b)
+		}
+	}
+	if best == nil {
+		return nil, ErrBrowserNotFound
+	}
+	return best, nil
+}
+
+func (x *MemoryStore) findBrowser(match func(Browser) bool) (*Browser, error) {
+	for _, b := range x.sortedBrowsers() {
+		if match(b) {
+			return copyBrowser(b), nil
+		}
+	}
+	return nil, ErrBrowserNotFound
+}
+
+// Apply a cookie write the way a JSON set mutation would, returning the cookie's uid.
+func (x *MemoryStore) write(update Cookie) string {
+	uid := x.resolve(update.Uid)
+	cookie, ok := x.cookies[uid]
+	if !ok {
+		cookie = &Cookie{Uid: uid}
+		x.cookies[uid] = cookie
+	}
+	cookie.CookieID = update.CookieID
+	if update.IssuedAt != nil {
+		cookie.IssuedAt = update.IssuedAt
+	}
+	if update.SeenAt != nil {
+		cookie.SeenAt = update.SeenAt
+	}
+	// list predicates only ever gain values on a set
+	for _, tag := range update.Tags {
+		if !contains(cookie.Tags, tag) {
+			cookie.Tags = append(cookie.Tags, tag)
+		}
+	}
+
+	for _, b := range update.Browsers {
+		b.Uid = x.resolve(b.Uid)
+		for i := range b.Enrichments {
+			b.Enrichments[i].Uid = x.resolve(b.Enrichments[i].Uid)
+		}
+		edge := Browser{Uid: b.Uid, FirstSeen: b.FirstSeen, LastSeen: b.LastSeen, Hits: b.Hits, Source: b.Source}
+		b.FirstSeen, b.LastSeen, b.Hits, b.Source, b.DType = nil, nil, 0, "", nil
+		x.browsers[b.Uid] = *copyBrowser(b)
+		if i := cookie.browserEdge(b.Uid); i >= 0 {
+			cookie.Browsers[i] = edge
+		} else {
+			cookie.Browsers = append(cookie.Browsers, edge)
+		}
+	}
+	for _, p := range update.Partners {
+		p.Uid = x.resolve(p.Uid)
+		edge := Partner{Uid: p.Uid, FirstSeen: p.FirstSeen, LastSeen: p.LastSeen, Hits: p.Hits, Source: p.Source}
+		x.partners[p.Uid] = Partner{Uid: p.Uid, PartnerID: p.PartnerID, CookieID: p.CookieID}
+		if i := cookie.partnerEdge(p.Uid); i >= 0 {
+			cookie.Partners[i] = edge
+		} else {
+			cookie.Partners = append(cookie.Partners, edge)
+		}
+	}
+	return uid
+}
+
+// The cookie as a graph query returns it, nodes filled in under their edge facets.
+func (x *MemoryStore) assemble(cookie *Cookie) *Cookie {
+	out := *cookie
+	out.Tags = append([]string(nil), cookie.Tags...)
+	out.Browsers = nil
+	out.Partners = nil
+	for _, edge := range cookie.Browsers {
+		b := copyBrowser(x.browsers[edge.Uid])
+		b.FirstSeen, b.LastSeen, b.Hits, b.Source = edge.FirstSeen, edge.LastSeen, edge.Hits, edge.Source
+		out.Browsers = append(out.Browsers, *b)
+	}
+	for _, edge := range cookie.Partners {
+		p := x.partners[edge.Uid]
+		p.FirstSeen, p.LastSeen, p.Hits, p.Source = edge.FirstSeen, edge.LastSeen, edge.Hits, edge.Source
+		out.Partners = append(out.Partners, p)
+	}
+	return &out
+}
+
+func (x *MemoryStore) resolve(uid string) string {
+	if uid != "" && !strings.HasPrefix(uid, "_:") {
+		return uid
+	}
+	x.next++
+	return fmt.Sprintf("0x%x", x.next)
+}
+
+func (x *MemoryStore) sortedCookies() []*Cookie {
+	cookies := make([]*Cookie, 0, len(x.cookies))
+	for _, cookie := range x.cookies {
+		cookies = append(cookies, cookie)
+	}
+	sort.Slice(cookies, func(i, j int) bool { return uidValue(cookies[i].Uid) < uidValue(cookies[j].Uid) })
+	return cookies
+}
+
+func (x *MemoryStore) sortedBrowsers() []Browser {
+	browsers := make([]Browser, 0, len(x.browsers))
+	for _, b := range x.browsers {
+		browsers = append(browsers, b)
+	}
+	sort.Slice(browsers, func(i, j int) bool { return uidValue(browsers[i].Uid) < uidValue(browsers[j].Uid) })
+	return browsers
+}
+
+// The index of the edge to a browser node, -1 when the cookie does not link to it.
+func (x *Cookie) browserEdge(uid string) int {
+	for i, b := range x.Browsers {
+		if b.Uid == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (x *Cookie) partnerEdge(uid string) int {
+	for i, p := range x.Partners {
+		if p.Uid == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+func uidValue(uid string) uint64 {
+	v, _ := strconv.ParseUint(strings.TrimPrefix(uid, "0x"), 16, 64)
+	return v
+}
+
+func copyBrowser(b Browser) *Browser {
+	b.Enrichments = append([]Enrichment(nil), b.Enrichments...)
+	return &b
+}
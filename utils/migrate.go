@@ -0,0 +1,434 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	api "github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/rs/zerolog/log"
+)
+
+const MIGRATION_BATCH = 500
+
+var ErrSchemaBehind = errors.New("schema version behind, run monster migrate up")
+
+// One step of schema evolution.  Schema is applied with Alter, then Backfill fixes existing data.
+type Migration struct {
+	Version  int
+	Name     string
+	Schema   string
+	Backfill func(ctx context.Context, x *Dgraph) error
+}
+
+// Recorded in the graph once a migration has been applied.
+type SchemaMigration struct {
+	Uid        string    `json:"uid,omitempty"`
+	Version    int       `json:"schema_version"`
+	Name       string    `json:"schema_migration"`
+	MigratedAt time.Time `json:"migrated_at"`
+	DType      []string  `json:"dgraph.type,omitempty"`
+}
+
+// Where the graph stands against the migrations this binary knows.
+type MigrationStatus struct {
+	Current int         `json:"current"`
+	Latest  int         `json:"latest"`
+	Pending []Migration `json:"-"`
+}
+
+const MIGRATION_SCHEMA = `
+	schema_version: int @index(int) .
+	schema_migration: string .
+	migrated_at: datetime .
+
+	type SchemaMigration {
+		schema_version: int
+		schema_migration: string
+		migrated_at: datetime
+	}
+`
+
+// Append only, never edit a migration that has shipped.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Schema: `
+
+			cookie: string @index(hash) .
+			issued: datetime .
+			tag: [string] @index(exact) .
+			Browser: [uid] .
+			Partner: [uid] .
+			addr: string @index(hash) .
+			useragent: string @index(hash) .
+			count: int .
+			traffic: string @index(exact) .
+			anonymizer: string @index(exact) .
+			browser_family: string @index(exact) .
+			browser_version: string .
+			browser_major: int @index(int) .
+			os_family: string @index(exact) .
+			os_version: string .
+			device_type: string @index(exact) .
+			device_vendor: string @index(exact) .
+			ch_ua: string .
+			ch_ua_full_version_list: string .
+			ch_ua_mobile: string .
+			ch_ua_platform: string @index(exact) .
+			ch_ua_platform_version: string .
+			ch_ua_model: string @index(exact) .
+			ch_ua_arch: string .
+			ch_ua_bitness: string .
+			geo_country: string @index(exact) .
+			geo_region: string @index(exact) .
+			geo_city: string @index(exact) .
+			geo_asn: int @index(int) .
+			geo_org: string @index(term) .
+			enrichment: [uid] .
+			enricher: string @index(exact) .
+			enriched_at: datetime .
+			attribute: string @index(exact) .
+			value_type: string .
+			value: string @index(exact) .
+			pid: string .
+			pcookie: string @index(hash) .
+	
+			type Browser {
+				addr: string
+				useragent: string
+				count: int
+				traffic: string
+				anonymizer: string
+				browser_family: string
+				browser_version: string
+				browser_major: int
+				os_family: string
+				os_version: string
+				device_type: string
+				device_vendor: string
+				ch_ua: string
+				ch_ua_full_version_list: string
+				ch_ua_mobile: string
+				ch_ua_platform: string
+				ch_ua_platform_version: string
+				ch_ua_model: string
+				ch_ua_arch: string
+				ch_ua_bitness: string
+				geo_country: string
+				geo_region: string
+				geo_city: string
+				geo_asn: int
+				geo_org: string
+				enrichment: [Enrichment]
+			}
+			type Enrichment {
+				enricher: string
+				enriched_at: datetime
+				attribute: string
+				value_type: string
+				value: string
+			}		
+			type Partner {
+				pid: string!
+				pcookie: string!
+			}
+			type Cookie {
+				cookie: string! 
+				issued: datetime
+				tag: [string]
+				Browser: [Browser]
+				Partner: [Partner]
+			}
+		`,
+	},
+	{
+		Version:  2,
+		Name:     "parse existing user-agents",
+		Backfill: backfillUserAgents,
+	},
+	{
+		Version: 3,
+		Name:    "align edges with struct tags",
+		Schema: `
+			browser: [uid] @reverse .
+			partner: [uid] @reverse .
+
+			type Cookie {
+				cookie: string
+				issued: datetime
+				tag: [string]
+				browser: [Browser]
+				partner: [Partner]
+			}
+		`,
+		Backfill: backfillTypes,
+	},
+	{
+		Version: 4,
+		Name:    "track when cookies were last seen",
+		Schema: `
+			seen: datetime @index(hour) .
+
+			type Cookie {
+				cookie: string
+				issued: datetime
+				seen: datetime
+				tag: [string]
+				browser: [Browser]
+				partner: [Partner]
+			}
+		`,
+		Backfill: backfillSeen,
+	},
+}
+
+func LatestVersion(migrations []Migration) int {
+	latest := 0
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+// The highest migration recorded in the graph, 0 for a graph that predates versioning.
+func (x *Dgraph) SchemaVersion(ctx context.Context) (int, error) {
+	txn := x.dg.NewReadOnlyTxn().BestEffort()
+	defer txn.Discard(ctx)
+
+	resp, err := txn.Query(ctx, `{
+		all(func: has(schema_version), orderdesc: schema_version, first: 1) { schema_version }
+	}`)
+	if err != nil {
+		log.Error().Err(err).Str("component", "migrate").Msg("schema version")
+		return 0, err
+	}
+	var data struct {
+		All []SchemaMigration `json:"all"`
+	}
+	if err := json.Unmarshal(resp.Json, &data); err != nil {
+		return 0, err
+	}
+	if len(data.All) == 0 {
+		return 0, nil
+	}
+	return data.All[0].Version, nil
+}
+
+func (x *Dgraph) MigrationStatus(ctx context.Context, migrations []Migration) (*MigrationStatus, error) {
+	current, err := x.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &MigrationStatus{Current: current, Latest: LatestVersion(migrations)}
+	for _, m := range migrations {
+		if m.Version > current {
+			status.Pending = append(status.Pending, m)
+		}
+	}
+	return status, nil
+}
+
+// Refuse to serve from a graph older than this binary expects.
+func (x *Dgraph) CheckSchemaVersion(ctx context.Context, migrations []Migration) error {
+	status, err := x.MigrationStatus(ctx, migrations)
+	if err != nil {
+		return err
+	}
+	if status.Current < status.Latest {
+		return fmt.Errorf("%w: at %d, want %d", ErrSchemaBehind, status.Current, status.Latest)
+	}
+	return nil
+}
+
+// Apply pending migrations in order, recording each one as it completes so a failure resumes there.
+func (x *Dgraph) Migrate(ctx context.Context, migrations []Migration) ([]Migration, error) {
+	if err := x.dg.Alter(ctx, &api.Operation{Schema: MIGRATION_SCHEMA}); err != nil {
+		log.Error().Err(err).Str("component", "migrate").Msg("bookkeeping schema")
+		return nil, err
+	}
+	status, err := x.MigrationStatus(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, m := range status.Pending {
+		if m.Schema != "" {
+			if err := x.dg.Alter(ctx, &api.Operation{Schema: m.Schema}); err != nil {
+				log.Error().Err(err).Str("component", "migrate").Int("version", m.Version).Msg("alter")
+				return applied, err
+			}
+		}
+		if m.Backfill != nil {
+			if err := m.Backfill(ctx, x); err != nil {
+				log.Error().Err(err).Str("component", "migrate").Int("version", m.Version).Msg("backfill")
+				return applied, err
+			}
+		}
+		if err := x.recordMigration(ctx, m); err != nil {
+			return applied, err
+		}
+		log.Info().Str("component", "migrate").Int("version", m.Version).Str("name", m.Name).Msg("applied")
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func (x *Dgraph) recordMigration(ctx context.Context, m Migration) error {
+	pb, err := json.Marshal(SchemaMigration{
+		Uid:        "_:migration",
+		Version:    m.Version,
+		Name:       m.Name,
+		MigratedAt: time.Now().UTC(),
+		DType:      []string{"SchemaMigration"}})
+	if err != nil {
+		return err
+	}
+	err = x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		_, err := txn.Mutate(ctx, &api.Mutation{SetJson: pb})
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "migrate").Int("version", m.Version).Msg("record")
+	}
+	return err
+}
+
+// Run query with $first set to size and hand each page to apply in its own transaction, until the
+// query comes back empty.  The query must stop selecting nodes once apply has fixed them, and
+// apply sees the page again when the transaction is aborted and retried.
+func (x *Dgraph) Backfill(ctx context.Context, query string, size int, apply func(ctx context.Context, txn *dgo.Txn, resp []byte) (int, error)) (int, error) {
+	total := 0
+	for {
+		n := 0
+		err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+			resp, err := txn.QueryWithVars(ctx, query, map[string]string{"$first": fmt.Sprint(size)})
+			if err != nil {
+				return err
+			}
+			n, err = apply(ctx, txn, resp.Json)
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+		total += n
+		log.Debug().Str("component", "migrate").Int("batch", n).Int("total", total).Msg("backfill")
+	}
+}
+
+// Browsers written before user-agents were parsed get their family, version and device fields.
+func backfillUserAgents(ctx context.Context, x *Dgraph) error {
+	query := `query all($first: int) {
+		all(func: has(useragent), first: $first) @filter(NOT has(device_type)) {` + BROWSER_FIELDS + `}
+	}`
+	_, err := x.Backfill(ctx, query, MIGRATION_BATCH, func(ctx context.Context, txn *dgo.Txn, resp []byte) (int, error) {
+		var data BrowserResponse
+		if err := json.Unmarshal(resp, &data); err != nil {
+			return 0, err
+		}
+		if len(data.All) == 0 {
+			return 0, nil
+		}
+		for i := range data.All {
+			b := &data.All[i]
+			b.SetUserAgent(ParseUserAgentWithHints(b.UserAgent, b.ClientHints))
+		}
+		pb, err := json.Marshal(data.All)
+		if err != nil {
+			return 0, err
+		}
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: pb})
+		return len(data.All), err
+	})
+	return err
+}
+
+// Nodes written before dgraph.type was set get their type, then the unused capitalised edges go.
+func backfillTypes(ctx context.Context, x *Dgraph) error {
+	types := []struct{ predicate, name string }{
+		{"cookie", "Cookie"},
+		{"useragent", "Browser"},
+		{"pid", "Partner"},
+		{"enricher", "Enrichment"}}
+	for _, t := range types {
+		query := `query all($first: int) {
+			all(func: has(` + t.predicate + `), first: $first) @filter(NOT has(dgraph.type)) { uid }
+		}`
+		_, err := x.Backfill(ctx, query, MIGRATION_BATCH, func(ctx context.Context, txn *dgo.Txn, resp []byte) (int, error) {
+			var data struct {
+				All []struct {
+					Uid   string   `json:"uid"`
+					DType []string `json:"dgraph.type"`
+				} `json:"all"`
+			}
+			if err := json.Unmarshal(resp, &data); err != nil {
+				return 0, err
+			}
+			if len(data.All) == 0 {
+				return 0, nil
+			}
+			for i := range data.All {
+				data.All[i].DType = []string{t.name}
+			}
+			pb, err := json.Marshal(data.All)
+			if err != nil {
+				return 0, err
+			}
+			_, err = txn.Mutate(ctx, &api.Mutation{SetJson: pb})
+			return len(data.All), err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, predicate := range []string{"Browser", "Partner"} {
+		if err := x.dg.Alter(ctx, &api.Operation{DropOp: api.Operation_ATTR, DropValue: predicate}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cookies from before seen was kept start their retention window at the upgrade, not at issue.
+func backfillSeen(ctx context.Context, x *Dgraph) error {
+	query := `query all($first: int) {
+		all(func: type(Cookie), first: $first) @filter(NOT has(seen)) { uid }
+	}`
+	now := time.Now().UTC()
+	_, err := x.Backfill(ctx, query, MIGRATION_BATCH, func(ctx context.Context, txn *dgo.Txn, resp []byte) (int, error) {
+		var data struct {
+			All []struct {
+				Uid  string    `json:"uid"`
+				Seen time.Time `json:"seen"`
+			} `json:"all"`
+		}
+		if err := json.Unmarshal(resp, &data); err != nil {
+			return 0, err
+		}
+		if len(data.All) == 0 {
+			return 0, nil
+		}
+		for i := range data.All {
+			data.All[i].Seen = now
+		}
+		pb, err := json.Marshal(data.All)
+		if err != nil {
+			return 0, err
+		}
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: pb})
+		return len(data.All), err
+	})
+	return err
+}
@@ -0,0 +1,275 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	api "github.com/dgraph-io/dgo/v2/protos/api"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RECONCILE_BATCH = 100
+	RECONCILE_PAGE  = 1000
+)
+
+// One reconciliation, the duplicate nodes of a cookie id folded into the canonical one.
+type ReconcileRecord struct {
+	CookieID     string     `json:"cookie_id"`
+	Canonical    string     `json:"canonical"`
+	Merged       []string   `json:"merged"`
+	IssuedAt     *time.Time `json:"issued,omitempty"`
+	Browsers     int        `json:"browsers"`
+	Partners     int        `json:"partners"`
+	Inline       bool       `json:"inline"`
+	ReconciledAt time.Time  `json:"reconciled_at"`
+	// the canonical node as the merge wrote it, a read after the commit may not see it yet
+	Cookie *Cookie `json:"-"`
+}
+
+func newReconcileRecord(canonical *Cookie, merged []string) *ReconcileRecord {
+	return &ReconcileRecord{
+		CookieID:     canonical.CookieID,
+		Canonical:    canonical.Uid,
+		Merged:       merged,
+		IssuedAt:     canonical.IssuedAt,
+		Browsers:     len(canonical.Browsers),
+		Partners:     len(canonical.Partners),
+		ReconciledAt: time.Now().UTC(),
+		Cookie:       canonical}
+}
+
+// Merges cookie ids that ended up on more than one node, on a schedule and whenever a lookup
+// runs into them.  It wraps the store, so the server sees one node per cookie id.
+type Reconciler struct {
+	IdentityStore
+	auditFile string
+	batch     int
+	mu        sync.Mutex
+	stop      chan struct{}
+	once      sync.Once
+}
+
+// auditFile is appended one JSON record per merge, empty keeps the records in the log only.
+func NewReconciler(store IdentityStore, auditFile string, batch int) *Reconciler {
+	if batch <= 0 {
+		batch = RECONCILE_BATCH
+	}
+	return &Reconciler{IdentityStore: store, auditFile: auditFile, batch: batch, stop: make(chan struct{})}
+}
+
+// A lookup that hits duplicates reconciles them and answers with the canonical node.
+func (x *Reconciler) FindCookie(ctx context.Context, cookieID string) (*Cookie, error) {
+	cookie, err := x.IdentityStore.FindCookie(ctx, cookieID)
+	if err != ErrDuplicateCookiesExist {
+		return cookie, err
+	}
+	record, err := x.reconcile(ctx, cookieID, true)
+	if err != nil {
+		log.Error().Err(err).Str("component", "reconcile").Str("cookie-id", cookieID).Msg("inline")
+		return cookie, ErrDuplicateCookiesExist
+	}
+	if record != nil {
+		return record.Cookie, nil
+	}
+	// another lookup or the sweep merged them first
+	return x.IdentityStore.FindCookie(ctx, cookieID)
+}
+
+// One pass over up to a batch of duplicated cookie ids.
+func (x *Reconciler) Sweep(ctx context.Context) ([]ReconcileRecord, error) {
+	records := []ReconcileRecord{}
+	ids, err := x.FindDuplicateCookieIDs(ctx, x.batch)
+	if err != nil {
+		return records, err
+	}
+	for _, id := range ids {
+		record, err := x.reconcile(ctx, id, false)
+		if err != nil {
+			return records, err
+		}
+		if record != nil {
+			records = append(records, *record)
+		}
+	}
+	log.Info().Str("component", "reconcile").Int("cookies", len(records)).Msg("sweep")
+	return records, nil
+}
+
+// Sweep on a fixed interval until Close is called, a zero interval disables it.
+func (x *Reconciler) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := x.Sweep(context.Background()); err != nil {
+					log.Error().Err(err).Str("component", "reconcile").Msg("sweep")
+				}
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *Reconciler) Close() {
+	x.once.Do(func() { close(x.stop) })
+}
+
+func (x *Reconciler) reconcile(ctx context.Context, cookieID string, inline bool) (*ReconcileRecord, error) {
+	record, err := x.ReconcileCookie(ctx, cookieID)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	record.Inline = inline
+	log.Info().Str("component", "reconcile").Str("cookie-id", cookieID).Str("canonical", record.Canonical).
+		Strs("merged", record.Merged).Bool("inline", inline).Msg("merged")
+	// the merge is committed, a lost audit line is logged and never fails it
+	if err := x.audit(*record); err != nil {
+		log.Error().Err(err).Str("component", "reconcile").Str("file", x.auditFile).Str("cookie-id", cookieID).Msg("audit")
+	}
+	return record, nil
+}
+
+func (x *Reconciler) audit(record ReconcileRecord) error {
+	if x.auditFile == "" {
+		return nil
+	}
+	pb, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	f, err := os.OpenFile(x.auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(pb, '\n'))
+	return err
+}
+
+// Cookie ids held by more than one node, at most limit of them, 0 for all.  Cookies are read a
+// page at a time and only the nodes sharing the page's ids are grouped, no query spans the graph.
+func (x *Dgraph) FindDuplicateCookieIDs(ctx context.Context, limit int) ([]string, error) {
+	ids := []string{}
+	seen := map[string]bool{}
+	after := "0x0"
+	for {
+		query := fmt.Sprintf(`{
+			page(func: type(Cookie), first: %d, after: %s) { uid ids as cookie }
+			all(func: eq(cookie, val(ids))) @groupby(cookie) { count(uid) }
+		}`, RECONCILE_PAGE, after)
+		resp, err := x.query(ctx, nil, query, nil)
+		if err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Msg("find duplicates")
+			return nil, err
+		}
+		var data struct {
+			Page []struct {
+				Uid string `json:"uid"`
+			} `json:"page"`
+			All []struct {
+				Groups []struct {
+					CookieID string `json:"cookie"`
+					Count    int    `json:"count"`
+				} `json:"@groupby"`
+			} `json:"all"`
+		}
+		if err := json.Unmarshal(resp.Json, &data); err != nil {
+			return nil, err
+		}
+		for _, all := range data.All {
+			for _, group := range all.Groups {
+				if group.Count < 2 || seen[group.CookieID] {
+					continue
+				}
+				seen[group.CookieID] = true
+				ids = append(ids, group.CookieID)
+				if limit > 0 && len(ids) == limit {
+					return ids, nil
+				}
+			}
+		}
+		if len(data.Page) < RECONCILE_PAGE {
+			return ids, nil
+		}
+		after = data.Page[len(data.Page)-1].Uid
+	}
+}
+
+// Fold every node holding cookieID into the earliest issued one in one transaction, nil when
+// there is only the one node.
+func (x *Dgraph) ReconcileCookie(ctx context.Context, cookieID string) (*ReconcileRecord, error) {
+	var record *ReconcileRecord
+	err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		record = nil
+		nodes, err := x.findCookieNodes(ctx, txn, cookieID)
+		if err != nil {
+			return err
+		}
+		if len(nodes) < 2 {
+			return nil
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return canonicalLess(&nodes[i], &nodes[j]) })
+		canonical := nodes[0]
+		merged := []string{}
+		deletes := []ErasedNode{}
+		for _, node := range nodes[1:] {
+			canonical.Merge(node)
+			merged = append(merged, node.Uid)
+			deletes = append(deletes, ErasedNode{Type: "Cookie", Uid: node.Uid})
+		}
+		canonical.SetTypes()
+		pb, err := json.Marshal(canonical)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Mutate(ctx, &api.Mutation{SetJson: pb}); err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "reconcile").Msg("mutate")
+			return err
+		}
+		if err := deleteNodes(ctx, txn, deletes, false); err != nil {
+			log.Error().Err(err).Str("component", "dgraph").Str("command", "reconcile").Msg("delete")
+			return err
+		}
+		record = newReconcileRecord(&canonical, merged)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (x *Dgraph) findCookieNodes(ctx context.Context, txn *dgo.Txn, cookieID string) ([]Cookie, error) {
+	query := fmt.Sprintf(`query all($cookie: string) {
+		all(func: eq(cookie, $cookie)) { %s }
+	}`, COOKIE_FIELDS)
+	resp, err := x.query(ctx, txn, query, map[string]string{"$cookie": cookieID})
+	if err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Msg("find cookie nodes")
+		return nil, err
+	}
+	var data CookieResponse
+	if err := json.Unmarshal(resp.Json, &data); err != nil {
+		return nil, err
+	}
+	if len(data.All) == 0 {
+		return nil, ErrCookieNotFound
+	}
+	return data.All, nil
+}
@@ -0,0 +1,213 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const RETENTION_BATCH = 500
+
+// What a sweep removed, or on a dry run would have removed.
+type RetentionReport struct {
+	DryRun      bool      `json:"dry_run"`
+	Cutoff      time.Time `json:"cutoff"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	Batches     int       `json:"batches"`
+	Cookies     int       `json:"cookies"`
+	Browsers    int       `json:"browsers"`
+	Enrichments int       `json:"enrichments"`
+	Partners    int       `json:"partners"`
+}
+
+func (x *RetentionReport) count(nodes []ErasedNode) {
+	for _, node := range nodes {
+		switch node.Type {
+		case "Cookie":
+			x.Cookies++
+		case "Browser":
+			x.Browsers++
+		case "Enrichment":
+			x.Enrichments++
+		case "Partner":
+			x.Partners++
+		}
+	}
+}
+
+// Expires identities not seen within the window on a schedule.
+type RetentionSweeper struct {
+	graph  *Dgraph
+	window time.Duration
+	batch  int
+	dryRun bool
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func NewRetentionSweeper(graph *Dgraph, window time.Duration, batch int, dryRun bool) *RetentionSweeper {
+	if batch <= 0 {
+		batch = RETENTION_BATCH
+	}
+	return &RetentionSweeper{graph: graph, window: window, batch: batch, dryRun: dryRun, stop: make(chan struct{})}
+}
+
+func (x *RetentionSweeper) Sweep(ctx context.Context) (RetentionReport, error) {
+	report, err := x.graph.SweepDormant(ctx, time.Now().UTC().Add(-x.window), x.batch, x.dryRun)
+	event := log.Info()
+	if err != nil {
+		event = log.Error().Err(err)
+	}
+	event.Str("component", "retention").Bool("dry-run", report.DryRun).Int("cookies", report.Cookies).
+		Int("browsers", report.Browsers).Int("enrichments", report.Enrichments).Int("partners", report.Partners).Msg("sweep")
+	return report, err
+}
+
+// Sweep on a fixed interval until Close is called, a zero window or interval disables it.
+func (x *RetentionSweeper) Start(interval time.Duration) {
+	if x.window <= 0 || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				x.Sweep(context.Background())
+			case <-x.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (x *RetentionSweeper) Close() {
+	x.once.Do(func() { close(x.stop) })
+}
+
+// Delete cookies not seen since cutoff, the browsers, enrichments and partners left without a
+// live cookie, then nodes nothing links to at all.  Each batch of size roots is one transaction,
+// a dry run walks the same nodes and deletes nothing.
+func (x *Dgraph) SweepDormant(ctx context.Context, cutoff time.Time, size int, dryRun bool) (RetentionReport, error) {
+	report := RetentionReport{DryRun: dryRun, Cutoff: cutoff, StartedAt: time.Now().UTC()}
+	picked := &erasure{seen: map[string]bool{}}
+
+	live := func(owners []erasureNode) bool {
+		for _, owner := range owners {
+			if owner.Seen == nil || !owner.Seen.Before(cutoff) {
+				return true
+			}
+		}
+		return false
+	}
+	passes := []struct {
+		query string
+		pick  func(root erasureNode)
+	}{
+		{`query all($cutoff: string, $first: int) {
+			all(func: lt(seen, $cutoff), first: $first, after: %s) @filter(type(Cookie)) {
+				uid
+				browser {
+					uid
+					enrichment { uid }
+					~browser { uid seen }
+				}
+				partner {
+					uid
+					~partner { uid seen }
+				}
+			}
+		}`, func(cookie erasureNode) {
+			picked.add("Cookie", cookie.Uid)
+			for _, browser := range cookie.Browsers {
+				if !live(browser.Cookies) {
+					picked.browser(browser)
+				}
+			}
+			for _, partner := range cookie.Partners {
+				if !live(partner.Owners) {
+					picked.add("Partner", partner.Uid)
+				}
+			}
+		}},
+		{`query all($first: int) {
+			all(func: type(Browser), first: $first, after: %s) @filter(NOT has(~browser)) {
+				uid
+				enrichment { uid }
+			}
+		}`, picked.browser},
+		{`query all($first: int) {
+			all(func: type(Partner), first: $first, after: %s) @filter(NOT has(~partner)) { uid }
+		}`,
+			func(partner erasureNode) { picked.add("Partner", partner.Uid) }},
+	}
+
+	for _, pass := range passes {
+		vars := map[string]string{"$first": fmt.Sprint(size)}
+		if strings.Contains(pass.query, "$cutoff") {
+			vars["$cutoff"] = cutoff.Format(time.RFC3339Nano)
+		}
+		// uids ascend, so paging past the last root works whether or not the batch was deleted
+		after := "0x0"
+		for {
+			var batch []ErasedNode
+			var last string
+			err := x.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+				// an aborted attempt's picks are forgotten so the retry picks them again
+				for _, node := range batch {
+					delete(picked.seen, node.Uid)
+				}
+				batch, last = nil, ""
+				resp, err := txn.QueryWithVars(ctx, fmt.Sprintf(pass.query, after), vars)
+				if err != nil {
+					log.Error().Err(err).Str("component", "retention").Msg("query")
+					return err
+				}
+				var data struct {
+					All []erasureNode `json:"all"`
+				}
+				if err := json.Unmarshal(resp.Json, &data); err != nil {
+					return err
+				}
+				if len(data.All) == 0 {
+					return nil
+				}
+				last = data.All[len(data.All)-1].Uid
+
+				// seen outlives the batch so a browser shared across batches is counted once
+				picked.nodes = nil
+				for _, root := range data.All {
+					pass.pick(root)
+				}
+				batch = picked.nodes
+				if !dryRun && len(batch) > 0 {
+					if err := deleteNodes(ctx, txn, batch, false); err != nil {
+						log.Error().Err(err).Str("component", "retention").Msg("delete")
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+			if last == "" {
+				break
+			}
+			after = last
+			report.count(batch)
+			report.Batches++
+		}
+	}
+	report.CompletedAt = time.Now().UTC()
+	return report, nil
+}
@@ -0,0 +1,253 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrSchemaMismatch = errors.New("live schema does not match the Go structs")
+
+type PredicateSchema struct {
+	Predicate string `json:"predicate"`
+	Type      string `json:"type"`
+	List      bool   `json:"list,omitempty"`
+}
+
+type TypeField struct {
+	Name string `json:"name"`
+}
+
+type TypeSchema struct {
+	Name   string      `json:"name"`
+	Fields []TypeField `json:"fields"`
+}
+
+// Predicates and types, shaped like the answer to a `schema {}` query.
+type Schema struct {
+	Predicates []PredicateSchema `json:"schema"`
+	Types      []TypeSchema      `json:"types"`
+}
+
+// the node structs whose json tags define the graph
+var schemaStructs = []interface{}{Cookie{}, Browser{}, Partner{}, Enrichment{}, SchemaMigration{}}
+
+func (x PredicateSchema) String() string {
+	if x.List {
+		return "[" + x.Type + "]"
+	}
+	return x.Type
+}
+
+// The schema the Go structs marshal to, one type per struct named after it.
+func StructSchema() Schema {
+	schema := Schema{}
+	seen := map[string]bool{}
+	for _, s := range schemaStructs {
+		t := reflect.TypeOf(s)
+		ts := TypeSchema{Name: t.Name()}
+		for _, p := range structPredicates(t) {
+			ts.Fields = append(ts.Fields, TypeField{Name: p.Predicate})
+			if !seen[p.Predicate] {
+				seen[p.Predicate] = true
+				schema.Predicates = append(schema.Predicates, p)
+			}
+		}
+		schema.Types = append(schema.Types, ts)
+	}
+	return schema
+}
+
+func structPredicates(t reflect.Type) []PredicateSchema {
+	preds := []PredicateSchema{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && tag == "" {
+			preds = append(preds, structPredicates(f.Type)...)
+			continue
+		}
+		if tag == "" || tag == "-" || tag == "uid" || tag == "dgraph.type" || strings.Contains(tag, "|") {
+			continue
+		}
+		p := PredicateSchema{Predicate: tag}
+		p.Type, p.List = dgraphType(f.Type)
+		preds = append(preds, p)
+	}
+	return preds
+}
+
+func dgraphType(t reflect.Type) (string, bool) {
+	list := false
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice {
+		list = true
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return "datetime", list
+		}
+		return "uid", list
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int", list
+	case reflect.Float32, reflect.Float64:
+		return "float", list
+	case reflect.Bool:
+		return "bool", list
+	}
+	return "string", list
+}
+
+// Read schema text as given to Alter, predicate lines and `type X { ... }` blocks.
+func ParseSchema(text string) Schema {
+	schema := Schema{}
+	current := -1
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "type ") && strings.HasSuffix(line, "{"):
+			name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "type "), "{"))
+			schema.Types = append(schema.Types, TypeSchema{Name: name})
+			current = len(schema.Types) - 1
+		case line == "}":
+			current = -1
+		case current >= 0:
+			name := strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+			schema.Types[current].Fields = append(schema.Types[current].Fields, TypeField{Name: name})
+		default:
+			parts := strings.SplitN(line, ":", 2)
+			fields := []string{}
+			if len(parts) == 2 {
+				fields = strings.Fields(parts[1])
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			schema.Predicates = append(schema.Predicates, PredicateSchema{
+				Predicate: strings.TrimSpace(parts[0]),
+				Type:      strings.Trim(fields[0], "[]"),
+				List:      strings.HasPrefix(fields[0], "[")})
+		}
+	}
+	return schema
+}
+
+// Layer other on top, later predicate and type definitions replace earlier ones as Alter does.
+func (x *Schema) Merge(other Schema) {
+	for _, p := range other.Predicates {
+		replaced := false
+		for i := range x.Predicates {
+			if x.Predicates[i].Predicate == p.Predicate {
+				x.Predicates[i] = p
+				replaced = true
+			}
+		}
+		if !replaced {
+			x.Predicates = append(x.Predicates, p)
+		}
+	}
+	for _, t := range other.Types {
+		replaced := false
+		for i := range x.Types {
+			if x.Types[i].Name == t.Name {
+				x.Types[i] = t
+				replaced = true
+			}
+		}
+		if !replaced {
+			x.Types = append(x.Types, t)
+		}
+	}
+}
+
+// The schema a fresh graph ends up with after every migration.
+func MigratedSchema(migrations []Migration) Schema {
+	schema := ParseSchema(MIGRATION_SCHEMA)
+	for _, m := range migrations {
+		schema.Merge(ParseSchema(m.Schema))
+	}
+	return schema
+}
+
+// Everything in expected that actual lacks or declares differently, extra predicates are fine.
+func CompareSchema(expected Schema, actual Schema) []string {
+	problems := []string{}
+	preds := map[string]PredicateSchema{}
+	for _, p := range actual.Predicates {
+		preds[p.Predicate] = p
+	}
+	for _, p := range expected.Predicates {
+		have, ok := preds[p.Predicate]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("predicate %s missing, want %s", p.Predicate, p))
+		} else if have.Type != p.Type || have.List != p.List {
+			problems = append(problems, fmt.Sprintf("predicate %s is %s, want %s", p.Predicate, have, p))
+		}
+	}
+
+	types := map[string]map[string]bool{}
+	for _, t := range actual.Types {
+		types[t.Name] = map[string]bool{}
+		for _, f := range t.Fields {
+			types[t.Name][f.Name] = true
+		}
+	}
+	for _, t := range expected.Types {
+		fields, ok := types[t.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("type %s missing", t.Name))
+			continue
+		}
+		for _, f := range t.Fields {
+			if !fields[f.Name] {
+				problems = append(problems, fmt.Sprintf("type %s lacks %s", t.Name, f.Name))
+			}
+		}
+	}
+	return problems
+}
+
+func (x *Dgraph) LiveSchema(ctx context.Context) (*Schema, error) {
+	txn := x.dg.NewReadOnlyTxn().BestEffort()
+	defer txn.Discard(ctx)
+
+	resp, err := txn.Query(ctx, `schema {}`)
+	if err != nil {
+		log.Error().Err(err).Str("component", "dgraph").Msg("schema query")
+		return nil, err
+	}
+	var schema Schema
+	if err := json.Unmarshal(resp.Json, &schema); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// Compare the live schema with the Go structs, logging every mismatch.
+func (x *Dgraph) CheckSchema(ctx context.Context) error {
+	live, err := x.LiveSchema(ctx)
+	if err != nil {
+		return err
+	}
+	problems := CompareSchema(StructSchema(), *live)
+	for _, problem := range problems {
+		log.Error().Str("component", "dgraph").Msg(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d problems", ErrSchemaMismatch, len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,692 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// identity store backends
+const (
+	STORE_DGRAPH = "dgraph"
+	STORE_SQL    = "sql"
+)
+
+// sql drivers
+const (
+	SQL_POSTGRES = "postgres"
+	SQL_SQLITE   = "sqlite"
+)
+
+// tables, a uid is the table and the row id so nodes of different types never share one
+const (
+	LINK_COOKIE  = "cookie"
+	LINK_BROWSER = "browser"
+	LINK_PARTNER = "partner"
+)
+
+var ErrSQLDriver = errors.New("unknown sql driver")
+
+// duplicate rows of a cookie, the canonical one first: earliest issued, then lowest id
+const CANONICAL_ORDER = "issued IS NULL, issued, id"
+
+type sqlCookie struct {
+	ID       uint64     `gorm:"primaryKey"`
+	CookieID string     `gorm:"column:cookie;uniqueIndex:idx_cookie_unique"`
+	IssuedAt *time.Time `gorm:"column:issued"`
+	SeenAt   *time.Time `gorm:"column:seen;index"`
+	Tags     string     `gorm:"column:tags"` // json array
+}
+
+// The matching columns are copied out of data, the whole Browser minus uid and facets.
+type sqlBrowser struct {
+	ID            uint64 `gorm:"primaryKey"`
+	Addr          string `gorm:"column:addr;index:idx_browser_match"`
+	UserAgent     string `gorm:"column:useragent;index:idx_browser_match"`
+	Anonymizer    string `gorm:"column:anonymizer"`
+	BrowserFamily string `gorm:"column:browser_family"`
+	OSFamily      string `gorm:"column:os_family"`
+	BrowserMajor  int    `gorm:"column:browser_major"`
+	Data          string `gorm:"column:data"`
+}
+
+type sqlPartner struct {
+	ID        uint64 `gorm:"primaryKey"`
+	PartnerID string `gorm:"column:pid"`
+	CookieID  string `gorm:"column:pcookie;index"`
+}
+
+// A cookie's edge to a browser or partner with its facets.  Key is what clusters join on: the
+// browser row, or the partner's cookie id since partner rows are per cookie as in the graph.
+type sqlLink struct {
+	ID        uint64     `gorm:"primaryKey"`
+	CookieRef uint64     `gorm:"column:cookie_ref;uniqueIndex:idx_link"`
+	Kind      string     `gorm:"column:kind;uniqueIndex:idx_link"`
+	NodeRef   uint64     `gorm:"column:node_ref;uniqueIndex:idx_link"`
+	Key       string     `gorm:"column:link_key;index"`
+	FirstSeen *time.Time `gorm:"column:first_seen"`
+	LastSeen  *time.Time `gorm:"column:last_seen"`
+	Hits      int        `gorm:"column:hits"`
+	Source    string     `gorm:"column:source"`
+}
+
+func (sqlCookie) TableName() string  { return "cookies" }
+func (sqlBrowser) TableName() string { return "browsers" }
+func (sqlPartner) TableName() string { return "partners" }
+func (sqlLink) TableName() string    { return "links" }
+
+// IdentityStore on relational tables through gorm, for deployments without a Dgraph cluster.
+type SQLStore struct {
+	db        *gorm.DB
+	tolerance int
+}
+
+// Open the database and create or extend the tables.
+func NewSQLStore(driver string, dsn string, tolerance int) (*SQLStore, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case SQL_POSTGRES:
+		dialector = postgres.Open(dsn)
+	case SQL_SQLITE:
+		dialector = sqlite.Open(dsn)
+	default:
+		return nil, ErrSQLDriver
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		log.Error().Err(err).Str("component", "sql").Str("driver", driver).Msg("open")
+		return nil, err
+	}
+	x := &SQLStore{db: db, tolerance: tolerance}
+	if err := x.upgradeCookies(); err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("upgrade cookies")
+		return nil, err
+	}
+	if err := db.AutoMigrate(&sqlCookie{}, &sqlBrowser{}, &sqlPartner{}, &sqlLink{}); err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("migrate")
+		return nil, err
+	}
+	return x, nil
+}
+
+// Tables from before the unique cookie index can hold a cookie id twice, the index cannot be
+// created over them until they are reconciled.  The plain index it replaces goes with them.
+func (x *SQLStore) upgradeCookies() error {
+	migrator := x.db.Migrator()
+	if !migrator.HasTable(&sqlCookie{}) || migrator.HasIndex(&sqlCookie{}, "idx_cookie_unique") {
+		return nil
+	}
+	ctx := context.Background()
+	ids, err := x.FindDuplicateCookieIDs(ctx, 0)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := x.ReconcileCookie(ctx, id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Info().Str("component", "sql").Int("cookies", len(ids)).Msg("merged duplicates")
+	}
+	if migrator.HasIndex(&sqlCookie{}, "idx_cookies_cookie") {
+		return migrator.DropIndex(&sqlCookie{}, "idx_cookies_cookie")
+	}
+	return nil
+}
+
+func (x *SQLStore) Close() error {
+	db, err := x.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func (x *SQLStore) Ping(ctx context.Context) error {
+	db, err := x.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+func (x *SQLStore) CreateCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	var created *Cookie
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if _, err := x.findCookie(tx, cookie.CookieID); err != ErrCookieNotFound {
+			if err == nil || err == ErrDuplicateCookiesExist {
+				return ErrCookieExists
+			}
+			return err
+		}
+		// seen drives retention, a cookie that never syncs still ages out from when it was issued
+		createdAt := time.Now()
+		cookie.IssuedAt = &createdAt
+		cookie.SeenAt = &createdAt
+		cookie.Uid = "_:cookie"
+		id, err := x.write(tx, cookie)
+		if err != nil {
+			return err
+		}
+		created, err = x.assemble(tx, id)
+		return err
+	})
+	return created, err
+}
+
+func (x *SQLStore) FindCookie(ctx context.Context, cookieID string) (*Cookie, error) {
+	return x.findCookie(x.db.WithContext(ctx), cookieID)
+}
+
+func (x *SQLStore) FindBrowser(ctx context.Context, ua string, ip string) (*Browser, error) {
+	return x.findBrowser(x.db.WithContext(ctx).Where("useragent = ? AND addr = ? AND anonymizer = ''", ua, ip).Order("id"))
+}
+
+func (x *SQLStore) FindCookieIDsByPartner(ctx context.Context, partnerCookieID string) ([]string, error) {
+	ids := []string{}
+	err := x.db.WithContext(ctx).Model(&sqlCookie{}).
+		Joins("JOIN links ON links.cookie_ref = cookies.id AND links.kind = ?", LINK_PARTNER).
+		Joins("JOIN partners ON partners.id = links.node_ref").
+		Where("partners.pcookie = ?", partnerCookieID).
+		Distinct("cookies.id", "cookies.cookie").Order("cookies.id").
+		Pluck("cookies.cookie", &ids).Error
+	if err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("find cookies by partner")
+	}
+	return ids, err
+}
+
+func (x *SQLStore) LinkCookie(ctx context.Context, cookieID string, browser Browser, partner Partner, tags []string) (*Cookie, error) {
+	var update *Cookie
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		cookie, err := x.lockCookie(tx, cookieID, now)
+		if err != nil {
+			return err
+		}
+		update, err = linkUpdate(cookie, browser, partner, tags, now, func(b Browser) (*Browser, error) {
+			return x.findSimilarBrowser(tx, b)
+		})
+		if err != nil {
+			return err
+		}
+		id, err := x.write(tx, *update)
+		update.Uid = sqlUid(LINK_COOKIE, id)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "sql").Str("command", "link").Msg("transaction")
+		return nil, err
+	}
+	return update, nil
+}
+
+func (x *SQLStore) MergeCookies(ctx context.Context, into string, from string) (*Cookie, error) {
+	if into == from {
+		return nil, ErrMergeSelf
+	}
+	var target *Cookie
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		target, err = x.findCookie(tx, into)
+		if err != nil && err != ErrDuplicateCookiesExist {
+			return err
+		}
+		source, err := x.findCookie(tx, from)
+		if err != nil && err != ErrDuplicateCookiesExist {
+			return err
+		}
+		target.Merge(*source)
+		if _, err := x.write(tx, *target); err != nil {
+			return err
+		}
+		sourceID := sqlID(source.Uid)
+		if err := tx.Where("cookie_ref = ?", sourceID).Delete(&sqlLink{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&sqlCookie{}, sourceID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (x *SQLStore) EraseCookie(ctx context.Context, cookieID string) ([]ErasedNode, error) {
+	erased := &erasure{seen: map[string]bool{}}
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var cookies []sqlCookie
+		if err := tx.Where("cookie = ?", cookieID).Order("id").Find(&cookies).Error; err != nil {
+			return err
+		}
+		if len(cookies) == 0 {
+			return ErrCookieNotFound
+		}
+		refs := []uint64{}
+		for _, c := range cookies {
+			refs = append(refs, c.ID)
+		}
+
+		for _, c := range cookies {
+			erased.add("Cookie", sqlUid(LINK_COOKIE, c.ID))
+			var links []sqlLink
+			if err := tx.Where("cookie_ref = ?", c.ID).Order("id").Find(&links).Error; err != nil {
+				return err
+			}
+			for _, link := range links {
+				// a node is orphaned once every cookie linking to it is being erased
+				var others int64
+				err := tx.Model(&sqlLink{}).Where("kind = ? AND node_ref = ? AND cookie_ref NOT IN ?", link.Kind, link.NodeRef, refs).Count(&others).Error
+				if err != nil {
+					return err
+				}
+				if others > 0 {
+					continue
+				}
+				if link.Kind == LINK_PARTNER {
+					erased.add("Partner", sqlUid(LINK_PARTNER, link.NodeRef))
+					continue
+				}
+				browser, err := x.findBrowser(tx.Where("id = ?", link.NodeRef))
+				if err != nil {
+					return err
+				}
+				erased.browser(erasureNode{Uid: browser.Uid, Enrichments: enrichmentNodes(browser.Enrichments)})
+			}
+		}
+
+		if err := tx.Where("cookie_ref IN ?", refs).Delete(&sqlLink{}).Error; err != nil {
+			return err
+		}
+		for _, node := range erased.nodes {
+			var err error
+			switch node.Type {
+			case "Cookie":
+				err = tx.Delete(&sqlCookie{}, sqlID(node.Uid)).Error
+			case "Browser":
+				err = tx.Delete(&sqlBrowser{}, sqlID(node.Uid)).Error
+			case "Partner":
+				err = tx.Delete(&sqlPartner{}, sqlID(node.Uid)).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return erased.nodes, nil
+}
+
+func (x *SQLStore) FindDuplicateCookieIDs(ctx context.Context, limit int) ([]string, error) {
+	ids := []string{}
+	query := x.db.WithContext(ctx).Model(&sqlCookie{}).Group("cookie").Having("COUNT(*) > 1").Order("MIN(id)")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Pluck("cookie", &ids).Error; err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("find duplicates")
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (x *SQLStore) ReconcileCookie(ctx context.Context, cookieID string) (*ReconcileRecord, error) {
+	var record *ReconcileRecord
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var rows []sqlCookie
+		if err := tx.Where("cookie = ?", cookieID).Order(CANONICAL_ORDER).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return ErrCookieNotFound
+		}
+		if len(rows) == 1 {
+			return nil
+		}
+		canonical, err := x.assemble(tx, rows[0].ID)
+		if err != nil {
+			return err
+		}
+		merged := []string{}
+		refs := []uint64{}
+		for _, row := range rows[1:] {
+			node, err := x.assemble(tx, row.ID)
+			if err != nil {
+				return err
+			}
+			canonical.Merge(*node)
+			merged = append(merged, node.Uid)
+			refs = append(refs, row.ID)
+		}
+		// the merged edges are rewritten onto the canonical row before the duplicates go
+		if err := tx.Where("cookie_ref IN ?", refs).Delete(&sqlLink{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&sqlCookie{}, refs).Error; err != nil {
+			return err
+		}
+		if _, err := x.write(tx, *canonical); err != nil {
+			return err
+		}
+		canonical, err = x.assemble(tx, rows[0].ID)
+		if err != nil {
+			return err
+		}
+		record = newReconcileRecord(canonical, merged)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (x *SQLStore) ScanCookies(ctx context.Context, after string, limit int) ([]Cookie, error) {
+	cookies := []Cookie{}
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var rows []sqlCookie
+		if err := tx.Where("id > ?", sqlID(after)).Order("id").Limit(limit).Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			cookie, err := x.assemble(tx, row.ID)
+			if err != nil {
+				return err
+			}
+			cookies = append(cookies, *cookie)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("scan cookies")
+		return nil, err
+	}
+	return cookies, nil
+}
+
+func (x *SQLStore) RestoreCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	var restored *Cookie
+	err := x.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if _, err := x.findCookie(tx, cookie.CookieID); err != ErrCookieNotFound {
+			if err == nil || err == ErrDuplicateCookiesExist {
+				return ErrCookieExists
+			}
+			return err
+		}
+		update, err := restoreUpdate(cookie, func(b Browser) (*Browser, error) {
+			return x.findSimilarBrowser(tx, b)
+		})
+		if err != nil {
+			return err
+		}
+		id, err := x.write(tx, *update)
+		if err != nil {
+			return err
+		}
+		restored, err = x.assemble(tx, id)
+		return err
+	})
+	return restored, err
+}
+
+// Cookies reach each other through links with the same key, walked by a recursive CTE.
+const CLUSTER_QUERY = `
+	WITH RECURSIVE cluster(cookie_ref, depth) AS (
+		SELECT id, 0 FROM cookies WHERE cookie = ?
+		UNION
+		SELECT other.cookie_ref, cluster.depth + 1 FROM cluster
+			JOIN links mine ON mine.cookie_ref = cluster.cookie_ref AND mine.link_key <> ''
+			JOIN links other ON other.link_key = mine.link_key
+		WHERE cluster.depth < ?
+	)
+	SELECT DISTINCT cookies.cookie FROM cluster JOIN cookies ON cookies.id = cluster.cookie_ref ORDER BY cookies.cookie`
+
+func (x *SQLStore) FindCluster(ctx context.Context, cookieID string) ([]string, error) {
+	ids := []string{}
+	if err := x.db.WithContext(ctx).Raw(CLUSTER_QUERY, cookieID, CLUSTER_DEPTH).Scan(&ids).Error; err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("find cluster")
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrCookieNotFound
+	}
+	return ids, nil
+}
+
+// Insert the cookie's row unless it is already there and hold it to the end of the transaction,
+// syncs for the same cookie then read and rewrite its facets one after the other.
+func (x *SQLStore) lockCookie(tx *gorm.DB, cookieID string, now time.Time) (*Cookie, error) {
+	row := sqlCookie{CookieID: cookieID, IssuedAt: &now, SeenAt: &now}
+	err := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "cookie"}}, DoNothing: true}).Create(&row).Error
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has no row locks, its writers already take turns on the whole database
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("cookie = ?", cookieID).Find(&[]sqlCookie{}).Error; err != nil {
+		return nil, err
+	}
+	return x.findCookie(tx, cookieID)
+}
+
+func (x *SQLStore) findCookie(tx *gorm.DB, cookieID string) (*Cookie, error) {
+	var rows []sqlCookie
+	if err := tx.Where("cookie = ?", cookieID).Order(CANONICAL_ORDER).Find(&rows).Error; err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("find cookie")
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrCookieNotFound
+	}
+	cookie, err := x.assemble(tx, rows[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 1 {
+		return cookie, ErrDuplicateCookiesExist
+	}
+	return cookie, nil
+}
+
+// The browser another cookie already created for this one, by exact (ua, ip) and then by family.
+func (x *SQLStore) findSimilarBrowser(tx *gorm.DB, browser Browser) (*Browser, error) {
+	existing, err := x.findBrowser(tx.Where("useragent = ? AND addr = ? AND anonymizer = ''", browser.UserAgent, browser.Addr).Order("id"))
+	if err != ErrBrowserNotFound || browser.BrowserFamily == "" || browser.OSFamily == "" || x.tolerance < 0 {
+		return existing, err
+	}
+	return x.findBrowser(tx.Where("addr = ? AND browser_family = ? AND os_family = ? AND browser_major BETWEEN ? AND ? AND anonymizer = ''",
+		browser.Addr, browser.BrowserFamily, browser.OSFamily, browser.BrowserMajor-x.tolerance, browser.BrowserMajor+x.tolerance).
+		Order("browser_major DESC, id"))
+}
+
+func (x *SQLStore) findBrowser(query *gorm.DB) (*Browser, error) {
+	var rows []sqlBrowser
+	if err := query.Limit(1).Find(&rows).Error; err != nil {
+		log.Error().Err(err).Str("component", "sql").Msg("find browser")
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrBrowserNotFound
+	}
+	var browser Browser
+	if err := json.Unmarshal([]byte(rows[0].Data), &browser); err != nil {
+		return nil, err
+	}
+	browser.Uid = sqlUid(LINK_BROWSER, rows[0].ID)
+	return &browser, nil
+}
+
+// The cookie as a graph query returns it, nodes filled in under their edge facets.
+func (x *SQLStore) assemble(tx *gorm.DB, id uint64) (*Cookie, error) {
+	var row sqlCookie
+	if err := tx.Where("id = ?", id).Find(&row).Error; err != nil {
+		return nil, err
+	}
+	cookie := &Cookie{Uid: sqlUid(LINK_COOKIE, row.ID), CookieID: row.CookieID, IssuedAt: row.IssuedAt, SeenAt: row.SeenAt}
+	if row.Tags != "" {
+		if err := json.Unmarshal([]byte(row.Tags), &cookie.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	var links []sqlLink
+	if err := tx.Where("cookie_ref = ?", id).Order("id").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if link.Kind == LINK_BROWSER {
+			browser, err := x.findBrowser(tx.Where("id = ?", link.NodeRef))
+			if err != nil {
+				return nil, err
+			}
+			browser.FirstSeen, browser.LastSeen, browser.Hits, browser.Source = link.FirstSeen, link.LastSeen, link.Hits, link.Source
+			cookie.Browsers = append(cookie.Browsers, *browser)
+			continue
+		}
+		var p sqlPartner
+		if err := tx.Where("id = ?", link.NodeRef).Find(&p).Error; err != nil {
+			return nil, err
+		}
+		cookie.Partners = append(cookie.Partners, Partner{Uid: sqlUid(LINK_PARTNER, p.ID), PartnerID: p.PartnerID, CookieID: p.CookieID,
+			FirstSeen: link.FirstSeen, LastSeen: link.LastSeen, Hits: link.Hits, Source: link.Source})
+	}
+	return cookie, nil
+}
+
+// Apply a cookie write the way a JSON set mutation would, returning the cookie's row id.
+func (x *SQLStore) write(tx *gorm.DB, update Cookie) (uint64, error) {
+	row := sqlCookie{}
+	if !isBlank(update.Uid) {
+		if err := tx.Where("id = ?", sqlID(update.Uid)).Find(&row).Error; err != nil {
+			return 0, err
+		}
+	}
+	row.CookieID = update.CookieID
+	if update.IssuedAt != nil {
+		row.IssuedAt = update.IssuedAt
+	}
+	if update.SeenAt != nil {
+		row.SeenAt = update.SeenAt
+	}
+	// list predicates only ever gain values on a set
+	tags := []string{}
+	if row.Tags != "" {
+		if err := json.Unmarshal([]byte(row.Tags), &tags); err != nil {
+			return 0, err
+		}
+	}
+	for _, tag := range update.Tags {
+		if !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	pb, err := json.Marshal(tags)
+	if err != nil {
+		return 0, err
+	}
+	row.Tags = string(pb)
+	if err := tx.Save(&row).Error; err != nil {
+		return 0, err
+	}
+
+	for _, b := range update.Browsers {
+		node := sqlBrowser{ID: sqlID(b.Uid), Addr: b.Addr, UserAgent: b.UserAgent, Anonymizer: b.Anonymizer,
+			BrowserFamily: b.BrowserFamily, OSFamily: b.OSFamily, BrowserMajor: b.BrowserMajor}
+		if isBlank(b.Uid) {
+			node.ID = 0
+			if err := tx.Create(&node).Error; err != nil {
+				return 0, err
+			}
+		}
+		data := b
+		data.Uid, data.FirstSeen, data.LastSeen, data.Hits, data.Source, data.DType = "", nil, nil, 0, "", nil
+		for i := range data.Enrichments {
+			if isBlank(data.Enrichments[i].Uid) {
+				data.Enrichments[i].Uid = fmt.Sprintf("enrichment:%d.%d", node.ID, i+1)
+			}
+			data.Enrichments[i].DType = nil
+		}
+		pb, err := json.Marshal(data)
+		if err != nil {
+			return 0, err
+		}
+		node.Data = string(pb)
+		if err := tx.Save(&node).Error; err != nil {
+			return 0, err
+		}
+		link := sqlLink{CookieRef: row.ID, Kind: LINK_BROWSER, NodeRef: node.ID, Key: sqlUid(LINK_BROWSER, node.ID),
+			FirstSeen: b.FirstSeen, LastSeen: b.LastSeen, Hits: b.Hits, Source: b.Source}
+		if err := x.saveLink(tx, link); err != nil {
+			return 0, err
+		}
+	}
+	for _, p := range update.Partners {
+		node := sqlPartner{ID: sqlID(p.Uid), PartnerID: p.PartnerID, CookieID: p.CookieID}
+		if isBlank(p.Uid) {
+			node.ID = 0
+		}
+		if err := tx.Save(&node).Error; err != nil {
+			return 0, err
+		}
+		link := sqlLink{CookieRef: row.ID, Kind: LINK_PARTNER, NodeRef: node.ID, Key: partnerKey(p),
+			FirstSeen: p.FirstSeen, LastSeen: p.LastSeen, Hits: p.Hits, Source: p.Source}
+		if err := x.saveLink(tx, link); err != nil {
+			return 0, err
+		}
+	}
+	return row.ID, nil
+}
+
+// Insert the edge or overwrite the facets of the one already there.
+func (x *SQLStore) saveLink(tx *gorm.DB, link sqlLink) error {
+	var existing sqlLink
+	if err := tx.Where("cookie_ref = ? AND kind = ? AND node_ref = ?", link.CookieRef, link.Kind, link.NodeRef).Find(&existing).Error; err != nil {
+		return err
+	}
+	link.ID = existing.ID
+	return tx.Save(&link).Error
+}
+
+// Partner cookie ids are only unique within the partner, and one that is missing links nothing.
+func partnerKey(p Partner) string {
+	if p.CookieID == "" {
+		return ""
+	}
+	return LINK_PARTNER + ":" + p.PartnerID + ":" + p.CookieID
+}
+
+func enrichmentNodes(enrichments []Enrichment) []erasureNode {
+	nodes := []erasureNode{}
+	for _, e := range enrichments {
+		nodes = append(nodes, erasureNode{Uid: e.Uid})
+	}
+	return nodes
+}
+
+func isBlank(uid string) bool {
+	return uid == "" || strings.HasPrefix(uid, "_:")
+}
+
+func sqlUid(table string, id uint64) string {
+	return table + ":" + strconv.FormatUint(id, 10)
+}
+
+func sqlID(uid string) uint64 {
+	id, _ := strconv.ParseUint(uid[strings.LastIndex(uid, ":")+1:], 10, 64)
+	return id
+}
@@ -0,0 +1,296 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+)
+
+// The identity graph as the server uses it.  DgraphStore backs production, SQLStore serves
+// deployments without a cluster and MemoryStore runs the same behaviour offline for tests.
+type IdentityStore interface {
+	Ping(ctx context.Context) error
+	CreateCookie(ctx context.Context, cookie Cookie) (*Cookie, error)
+	FindCookie(ctx context.Context, cookieID string) (*Cookie, error)
+	FindBrowser(ctx context.Context, ua string, ip string) (*Browser, error)
+	FindCookieIDsByPartner(ctx context.Context, partnerCookieID string) ([]string, error)
+	LinkCookie(ctx context.Context, cookieID string, browser Browser, partner Partner, tags []string) (*Cookie, error)
+	MergeCookies(ctx context.Context, into string, from string) (*Cookie, error)
+	EraseCookie(ctx context.Context, cookieID string) ([]ErasedNode, error)
+	FindCluster(ctx context.Context, cookieID string) ([]string, error)
+	FindDuplicateCookieIDs(ctx context.Context, limit int) ([]string, error)
+	ReconcileCookie(ctx context.Context, cookieID string) (*ReconcileRecord, error)
+	ScanCookies(ctx context.Context, after string, limit int) ([]Cookie, error)
+	RestoreCookie(ctx context.Context, cookie Cookie) (*Cookie, error)
+}
+
+// hops followed from a cookie when resolving the identity cluster it belongs to
+const CLUSTER_DEPTH = 8
+
+var ErrCookieExists = errors.New("cookie exists")
+var ErrMergeSelf = errors.New("cannot merge a cookie into itself")
+
+// The write a sync makes to cookie: the browser and partner edges with their facets bumped, nodes
+// not created yet carry "_:" uids.  find returns a browser another cookie already created.
+func linkUpdate(cookie *Cookie, browser Browser, partner Partner, tags []string, now time.Time, find func(Browser) (*Browser, error)) (*Cookie, error) {
+	// seen drives retention, every sync keeps the cookie alive
+	update := &Cookie{Uid: cookie.Uid, CookieID: cookie.CookieID, IssuedAt: cookie.IssuedAt, SeenAt: &now, Tags: tags}
+
+	// every sync rewrites the edges with fresh facets, reading the cookie in the same transaction
+	// makes the count increment atomic
+	if browser.UserAgent != "" && cookie.HasBrowser(browser) {
+		for _, b := range cookie.Browsers {
+			if b.UserAgent == browser.UserAgent && b.Addr == browser.Addr {
+				linked := b
+				linked.MergeEnrichments(browser.Enrichments)
+				linked.Touch(now, partner.PartnerID)
+				update.Browsers = append(update.Browsers, linked)
+				break
+			}
+		}
+	} else if browser.UserAgent != "" {
+		// an anonymizer address is shared by strangers, never link through it
+		var existing *Browser
+		err := ErrBrowserNotFound
+		if browser.Anonymizer == "" {
+			existing, err = find(browser)
+		}
+		if err == ErrBrowserNotFound {
+			browser.Uid = "_:browser"
+			browser.Touch(now, partner.PartnerID)
+			update.Browsers = append(update.Browsers, browser)
+		} else if err != nil {
+			return nil, err
+		} else {
+			if browser.Traffic != "" {
+				existing.Traffic = browser.Traffic
+			}
+			// the node follows the newest version seen
+			if browser.BrowserMajor >= existing.BrowserMajor && browser.BrowserFamily != "" {
+				existing.UserAgent = browser.UserAgent
+				existing.SetUserAgent(browser.ParsedUserAgent())
+			}
+			if !browser.ClientHints.IsEmpty() {
+				existing.ClientHints = browser.ClientHints
+			}
+			if browser.Geo != (Geo{}) {
+				existing.Geo = browser.Geo
+			}
+			existing.MergeEnrichments(browser.Enrichments)
+			// an older version of the browser may already hang off this cookie, keep its edge history
+			for _, b := range cookie.Browsers {
+				if b.Uid == existing.Uid {
+					existing.FirstSeen, existing.LastSeen, existing.Hits, existing.Source = b.FirstSeen, b.LastSeen, b.Hits, b.Source
+				}
+			}
+			existing.Touch(now, partner.PartnerID)
+			update.Browsers = append(update.Browsers, *existing)
+		}
+	}
+
+	if partner.PartnerID != "" {
+		linked := partner
+		linked.Uid = "_:partner"
+		for _, p := range cookie.Partners {
+			if p.PartnerID == partner.PartnerID && p.CookieID == partner.CookieID {
+				linked = p
+				break
+			}
+		}
+		linked.Touch(now, partner.PartnerID)
+		update.Partners = append(update.Partners, linked)
+	}
+	return update, nil
+}
+
+// Fold from's browsers, partners and tags into x.  An edge both cookies have keeps the earliest
+// first_seen and its source, the latest last_seen and the summed count.
+func (x *Cookie) Merge(from Cookie) {
+	if from.IssuedAt != nil && (x.IssuedAt == nil || from.IssuedAt.Before(*x.IssuedAt)) {
+		x.IssuedAt = from.IssuedAt
+	}
+	if from.SeenAt != nil && (x.SeenAt == nil || from.SeenAt.After(*x.SeenAt)) {
+		x.SeenAt = from.SeenAt
+	}
+	for _, tag := range from.Tags {
+		if !contains(x.Tags, tag) {
+			x.Tags = append(x.Tags, tag)
+		}
+	}
+
+	for _, b := range from.Browsers {
+		merged := false
+		for i := range x.Browsers {
+			if x.Browsers[i].Uid == b.Uid {
+				x.Browsers[i].FirstSeen, x.Browsers[i].LastSeen, x.Browsers[i].Source = mergeSeen(
+					x.Browsers[i].FirstSeen, x.Browsers[i].LastSeen, x.Browsers[i].Source, b.FirstSeen, b.LastSeen, b.Source)
+				x.Browsers[i].Hits += b.Hits
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			x.Browsers = append(x.Browsers, b)
+		}
+	}
+	for _, p := range from.Partners {
+		merged := false
+		for i := range x.Partners {
+			if x.Partners[i].Uid == p.Uid {
+				x.Partners[i].FirstSeen, x.Partners[i].LastSeen, x.Partners[i].Source = mergeSeen(
+					x.Partners[i].FirstSeen, x.Partners[i].LastSeen, x.Partners[i].Source, p.FirstSeen, p.LastSeen, p.Source)
+				x.Partners[i].Hits += p.Hits
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			x.Partners = append(x.Partners, p)
+		}
+	}
+}
+
+// Duplicates fold into the earliest issued node, the lowest uid breaking a tie, so every reconcile
+// of the same nodes keeps the same one.
+func canonicalLess(a, b *Cookie) bool {
+	if (a.IssuedAt == nil) != (b.IssuedAt == nil) {
+		return a.IssuedAt != nil
+	}
+	if a.IssuedAt != nil && !a.IssuedAt.Equal(*b.IssuedAt) {
+		return a.IssuedAt.Before(*b.IssuedAt)
+	}
+	return uidValue(a.Uid) < uidValue(b.Uid)
+}
+
+func mergeSeen(first, last *time.Time, source string, otherFirst, otherLast *time.Time, otherSource string) (*time.Time, *time.Time, string) {
+	if otherFirst != nil && (first == nil || otherFirst.Before(*first)) {
+		first, source = otherFirst, otherSource
+	}
+	if otherLast != nil && (last == nil || otherLast.After(*last)) {
+		last = otherLast
+	}
+	return first, last, source
+}
+
+// The cookie ids reachable from cookieID through shared browsers or partner cookie ids, itself
+// included and sorted.  neighbours returns ErrCookieNotFound for a cookie that is not there.
+func resolveCluster(cookieID string, neighbours func(cookieID string) ([]string, error)) ([]string, error) {
+	seen := map[string]bool{cookieID: true}
+	frontier := []string{cookieID}
+	for depth := 0; depth < CLUSTER_DEPTH && len(frontier) > 0; depth++ {
+		next := []string{}
+		for _, id := range frontier {
+			ids, err := neighbours(id)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range ids {
+				if !seen[other] {
+					seen[other] = true
+					next = append(next, other)
+				}
+			}
+		}
+		frontier = next
+	}
+	cluster := make([]string, 0, len(seen))
+	for id := range seen {
+		cluster = append(cluster, id)
+	}
+	sort.Strings(cluster)
+	return cluster, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityStore over Dgraph, each call runs in a transaction of its own.
+type DgraphStore struct {
+	graph *Dgraph
+}
+
+func NewDgraphStore(graph *Dgraph) *DgraphStore {
+	return &DgraphStore{graph: graph}
+}
+
+func (x *DgraphStore) Close() error {
+	return x.graph.Close()
+}
+
+func (x *DgraphStore) Ping(ctx context.Context) error {
+	return x.graph.Ping(ctx)
+}
+
+func (x *DgraphStore) CreateCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	var created *Cookie
+	err := x.graph.RunTxn(ctx, func(ctx context.Context, txn *dgo.Txn) error {
+		if _, err := x.graph.FindCookie(ctx, txn, cookie.CookieID); err != ErrCookieNotFound {
+			if err == nil || err == ErrDuplicateCookiesExist {
+				return ErrCookieExists
+			}
+			return err
+		}
+		cookie.Uid = "_:cookie"
+		var err error
+		created, err = x.graph.CreateCookie(ctx, txn, &cookie, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (x *DgraphStore) FindCookie(ctx context.Context, cookieID string) (*Cookie, error) {
+	return x.graph.FindCookie(ctx, nil, cookieID)
+}
+
+func (x *DgraphStore) FindBrowser(ctx context.Context, ua string, ip string) (*Browser, error) {
+	return x.graph.FindBrowser(ctx, nil, ua, ip)
+}
+
+func (x *DgraphStore) FindCookieIDsByPartner(ctx context.Context, partnerCookieID string) ([]string, error) {
+	return x.graph.FindCookieIDsByPartner(ctx, partnerCookieID)
+}
+
+func (x *DgraphStore) LinkCookie(ctx context.Context, cookieID string, browser Browser, partner Partner, tags []string) (*Cookie, error) {
+	return x.graph.LinkCookie(ctx, cookieID, browser, partner, tags)
+}
+
+func (x *DgraphStore) MergeCookies(ctx context.Context, into string, from string) (*Cookie, error) {
+	return x.graph.MergeCookies(ctx, into, from)
+}
+
+func (x *DgraphStore) EraseCookie(ctx context.Context, cookieID string) ([]ErasedNode, error) {
+	return x.graph.EraseCookie(ctx, cookieID)
+}
+
+func (x *DgraphStore) FindCluster(ctx context.Context, cookieID string) ([]string, error) {
+	return x.graph.FindCluster(ctx, cookieID)
+}
+
+func (x *DgraphStore) FindDuplicateCookieIDs(ctx context.Context, limit int) ([]string, error) {
+	return x.graph.FindDuplicateCookieIDs(ctx, limit)
+}
+
+func (x *DgraphStore) ReconcileCookie(ctx context.Context, cookieID string) (*ReconcileRecord, error) {
+	return x.graph.ReconcileCookie(ctx, cookieID)
+}
+
+func (x *DgraphStore) ScanCookies(ctx context.Context, after string, limit int) ([]Cookie, error) {
+	return x.graph.ScanCookies(ctx, after, limit)
+}
+
+func (x *DgraphStore) RestoreCookie(ctx context.Context, cookie Cookie) (*Cookie, error) {
+	return x.graph.RestoreCookie(ctx, cookie)
+}
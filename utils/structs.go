@@ -2,22 +2,50 @@
 package utils
 
 import (
+	"errors"
+	"net/http"
 	"time"
 
+	"github.com/osintami/monster/engine"
 	"github.com/osintami/plumbr/sink"
 )
 
 type ICache interface {
 	Get(key string) (interface{}, bool)
 	Set(key string, value interface{}, duration time.Duration)
+	Delete(key string)
+	Items() map[string]interface{}
 }
 
 type ServerCore struct {
 	Config   ServerConfig
 	Cache    ICache
+	Graph    IdentityStore
 	Secrets  *sink.SecretsManager
 	Shutdown *sink.ShutdownHandler
-	//Rules    *engine.RulesEngine
+	Rules    *engine.RulesEngine
+}
+
+var (
+	ErrRateLimitStatus = errors.New("RATE_LIMIT_STATUS must be 429 or 204")
+	ErrRetentionStore  = errors.New("RETENTION_WINDOW needs IDENTITY_STORE=dgraph")
+	ErrRetentionSync   = errors.New("RETENTION_WINDOW needs GRAPH_SYNC, without it seen never advances")
+)
+
+// Settings LoadEnv cannot check on its own, main refuses to start on an error.
+func (x ServerConfig) Validate() error {
+	if x.RateLimitStatus != http.StatusTooManyRequests && x.RateLimitStatus != http.StatusNoContent {
+		return ErrRateLimitStatus
+	}
+	// only the graph has a retention sweeper, a window on sql would keep nothing from growing
+	if x.RetentionWindow > 0 && x.IdentityStore == STORE_SQL {
+		return ErrRetentionStore
+	}
+	// only syncs move seen forward, a sweep without them would take live cookies
+	if x.RetentionWindow > 0 && !x.GraphSync {
+		return ErrRetentionSync
+	}
+	return nil
 }
 
 type ServerConfig struct {
@@ -27,7 +55,91 @@ type ServerConfig struct {
 	ListenAddr   string `env:"LISTEN_ADDR,required" envDefault:"127.0.0.1:8080"`
 	LogLevel     string `env:"LOG_LEVEL" envDefault:"TRACE"`
 	GinMode      string `env:"GIN_MODE" envDefault:"RELEASE"`
-	DgraphSvr    string `env:"DGRAPH_SVR" envDefault:"localhost:9080"`
-	DgraphUser   string `env:"DGRAPH_USER" envDefault:"groot"`
-	DgraphPass   string `env:"DGRAPH_PASS" envDefault:"password"`
+	// dgraph alphas, comma separated, requests are spread across them
+	DgraphSvrs []string `env:"DGRAPH_SVR" envSeparator:"," envDefault:"localhost:9080"`
+	// dgraph ACL login, the session is renewed by logging in again on the refresh interval
+	DgraphACL          bool          `env:"DGRAPH_ACL" envDefault:"false"`
+	DgraphUser         string        `env:"DGRAPH_USER"`
+	DgraphPass         string        `env:"DGRAPH_PASS"`
+	DgraphLoginRefresh time.Duration `env:"DGRAPH_LOGIN_REFRESH" envDefault:"1h"`
+	DgraphTimeout      time.Duration `env:"DGRAPH_TIMEOUT" envDefault:"10s"`
+	// dgraph TLS, the CA verifies the alphas and a client cert and key turn on mutual TLS
+	DgraphTLS        bool   `env:"DGRAPH_TLS" envDefault:"false"`
+	DgraphCACert     string `env:"DGRAPH_TLS_CA" envDefault:""`
+	DgraphClientCert string `env:"DGRAPH_TLS_CERT" envDefault:""`
+	DgraphClientKey  string `env:"DGRAPH_TLS_KEY" envDefault:""`
+	DgraphServerName string `env:"DGRAPH_TLS_SERVER_NAME" envDefault:""`
+	// writes that conflict with another transaction are retried with backoff until the deadline
+	DgraphRetryDeadline time.Duration `env:"DGRAPH_RETRY_DEADLINE" envDefault:"5s"`
+	// per-call deadlines, each lookup gets the query timeout and each write attempt the write timeout
+	DgraphQueryTimeout time.Duration `env:"DGRAPH_QUERY_TIMEOUT" envDefault:"2s"`
+	DgraphWriteTimeout time.Duration `env:"DGRAPH_WRITE_TIMEOUT" envDefault:"10s"`
+	// identity store backend, dgraph or sql, the sql driver is postgres or sqlite
+	IdentityStore string `env:"IDENTITY_STORE" envDefault:"dgraph"`
+	SQLDriver     string `env:"SQL_DRIVER" envDefault:"postgres"`
+	SQLDSN        string `env:"SQL_DSN" envDefault:""`
+	// graceful shutdown, how long to drain in-flight requests and graph writes
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"15s"`
+	GraphQueueSize  int           `env:"GRAPH_QUEUE_SIZE" envDefault:"1024"`
+	// queue every sync as an identity store write, off leaves the graph to the admin tools: no
+	// browser or partner edges, facets or seen stamps, so retention refuses to run without it
+	GraphSync bool `env:"GRAPH_SYNC" envDefault:"false"`
+	// cache persistence, snapshot period and whether to journal writes between snapshots
+	SnapshotInterval time.Duration `env:"CACHE_SNAPSHOT_INTERVAL" envDefault:"5m"`
+	CacheJournal     bool          `env:"CACHE_JOURNAL" envDefault:"false"`
+	// native TLS, off unless a cert and key are given, the redirect listener is optional
+	TLSCertFile       string        `env:"TLS_CERT_FILE" envDefault:""`
+	TLSKeyFile        string        `env:"TLS_KEY_FILE" envDefault:""`
+	TLSReloadInterval time.Duration `env:"TLS_RELOAD_INTERVAL" envDefault:"1m"`
+	RedirectAddr      string        `env:"REDIRECT_LISTEN_ADDR" envDefault:""`
+	// sync rate limits, a rate of 0 disables that limit, partner overrides are read from FSPath.  The
+	// ip limit is off by default, behind a load balancer it needs TRUSTED_PROXIES or every client
+	// shares the balancer's bucket
+	RateIPPerSecond      float64 `env:"RATE_IP_RPS" envDefault:"0"`
+	RateIPBurst          int     `env:"RATE_IP_BURST" envDefault:"20"`
+	RatePartnerPerSecond float64 `env:"RATE_PARTNER_RPS" envDefault:"500"`
+	RatePartnerBurst     int     `env:"RATE_PARTNER_BURST" envDefault:"1000"`
+	RatePartnerFile      string  `env:"RATE_PARTNER_FILE" envDefault:"partner_limits.json"`
+	RateLimitStatus      int     `env:"RATE_LIMIT_STATUS" envDefault:"429"`
+	RateMaxBuckets       int     `env:"RATE_MAX_BUCKETS" envDefault:"100000"`
+	// proxies whose X-Forwarded-For is believed, CIDRs or addresses, empty trusts only the peer.
+	// Behind a load balancer list its addresses here, or the ip limit, geo, datacenter tagging and
+	// the browser addr all see the balancer instead of the client
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:"," envDefault:""`
+	// non-human traffic, actions are store, tag, skip or drop, lists are read from FSPath
+	TrafficFilter    bool     `env:"TRAFFIC_FILTER" envDefault:"true"`
+	BotSignatureFile string   `env:"BOT_SIGNATURE_FILE" envDefault:"bot_signatures.txt"`
+	DatacenterFiles  []string `env:"DATACENTER_FILES" envSeparator:"," envDefault:"datacenter_cidrs.txt"`
+	BotAction        string   `env:"BOT_ACTION" envDefault:"skip"`
+	DatacenterAction string   `env:"DATACENTER_ACTION" envDefault:"tag"`
+	// anonymizer networks, tor exits and vpn/proxy ranges read from FSPath and reloaded
+	AnonymizerFilter bool          `env:"ANONYMIZER_FILTER" envDefault:"true"`
+	TorExitFiles     []string      `env:"TOR_EXIT_FILES" envSeparator:"," envDefault:"tor_exits.txt"`
+	VPNFiles         []string      `env:"VPN_FILES" envSeparator:"," envDefault:"vpn_cidrs.txt"`
+	AnonymizerReload time.Duration `env:"ANONYMIZER_RELOAD" envDefault:"1h"`
+	// browsers match across this many major versions on the same ip and OS, -1 for exact only
+	UAVersionTolerance int `env:"UA_VERSION_TOLERANCE" envDefault:"2"`
+	// user-agent client hints, requested with Accept-CH, the critical ones force a retry
+	ClientHints   bool     `env:"CLIENT_HINTS" envDefault:"true"`
+	CriticalHints []string `env:"CRITICAL_HINTS" envSeparator:"," envDefault:"Sec-CH-UA-Full-Version-List,Sec-CH-UA-Platform-Version"`
+	// geoip, MaxMind format databases read from FSPath and reopened when they change
+	GeoIPFiles  []string      `env:"GEOIP_FILES" envSeparator:"," envDefault:"GeoLite2-City.mmdb,GeoLite2-ASN.mmdb"`
+	GeoIPReload time.Duration `env:"GEOIP_RELOAD" envDefault:"1m"`
+	// osint enrichers, each call is cut off at the timeout and cacheable results kept for the ttl
+	EnrichTimeout  time.Duration `env:"ENRICH_TIMEOUT" envDefault:"250ms"`
+	EnrichCacheTTL time.Duration `env:"ENRICH_CACHE_TTL" envDefault:"1h"`
+	// sync policy, read from FSPath and re-read when the file changes
+	RulesFile   string        `env:"RULES_FILE" envDefault:"rules.json"`
+	RulesReload time.Duration `env:"RULES_RELOAD" envDefault:"30s"`
+	// bearer token for the /admin routes, they are not mounted without one
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// retention, cookies not seen within the window leave the graph and the cache, 0 keeps everything
+	RetentionWindow   time.Duration `env:"RETENTION_WINDOW" envDefault:"0"`
+	RetentionInterval time.Duration `env:"RETENTION_INTERVAL" envDefault:"24h"`
+	RetentionBatch    int           `env:"RETENTION_BATCH" envDefault:"500"`
+	RetentionDryRun   bool          `env:"RETENTION_DRY_RUN" envDefault:"false"`
+	// duplicate cookie nodes are merged on lookup and on this interval, merges are audited to FSPath
+	ReconcileInterval  time.Duration `env:"RECONCILE_INTERVAL" envDefault:"1h"`
+	ReconcileBatch     int           `env:"RECONCILE_BATCH" envDefault:"100"`
+	ReconcileAuditFile string        `env:"RECONCILE_AUDIT_FILE" envDefault:"reconcile_audit.jsonl"`
 }
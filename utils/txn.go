@@ -0,0 +1,64 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	TXN_BACKOFF        = 10 * time.Millisecond
+	TXN_BACKOFF_MAX    = time.Second
+	TXN_RETRY_DEADLINE = 5 * time.Second
+)
+
+// Run fn in a fresh transaction and commit it.  A transaction Dgraph aborts because another
+// writer got there first is run again from the start, after a jittered backoff that doubles each
+// time, until the retry deadline or ctx runs out.  Each attempt has the write timeout to finish.
+// fn must not commit and may run more than once.
+func (x *Dgraph) RunTxn(ctx context.Context, fn func(ctx context.Context, txn *dgo.Txn) error) error {
+	deadline := time.Now().Add(x.retryDeadline)
+	if x.retryDeadline <= 0 {
+		deadline = time.Now().Add(TXN_RETRY_DEADLINE)
+	}
+	backoff := TXN_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := x.runTxn(ctx, fn)
+		if !errors.Is(err, dgo.ErrAborted) {
+			return err
+		}
+		// a random wait in the upper half of the backoff keeps colliding writers out of step
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if time.Now().Add(wait).After(deadline) {
+			log.Warn().Err(err).Str("component", "dgraph").Int("attempts", attempt).Msg("txn retries exhausted")
+			return err
+		}
+		log.Debug().Str("component", "dgraph").Int("attempt", attempt).Dur("wait", wait).Msg("txn aborted, retrying")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > TXN_BACKOFF_MAX {
+			backoff = TXN_BACKOFF_MAX
+		}
+	}
+}
+
+func (x *Dgraph) runTxn(ctx context.Context, fn func(ctx context.Context, txn *dgo.Txn) error) error {
+	ctx, cancel := context.WithTimeout(ctx, x.writeTimeout)
+	defer cancel()
+	txn := x.dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	if err := fn(ctx, txn); err != nil {
+		return err
+	}
+	return txn.Commit(ctx)
+}
@@ -0,0 +1,257 @@
+// © 2022 Sloan Childers
+package utils
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEVICE_DESKTOP = "desktop"
+	DEVICE_MOBILE  = "mobile"
+	DEVICE_TABLET  = "tablet"
+	DEVICE_BOT     = "bot"
+	DEVICE_OTHER   = "other"
+)
+
+// The parts of a user-agent that survive minor browser updates.
+type UserAgent struct {
+	BrowserFamily  string
+	BrowserVersion string
+	OSFamily       string
+	OSVersion      string
+	DeviceType     string
+	DeviceVendor   string
+}
+
+type uaRule struct {
+	family string
+	regex  *regexp.Regexp
+}
+
+// first match wins, so the browsers that also claim to be Chrome or Safari come first
+var browserRules = []uaRule{
+	{"Bot", regexp.MustCompile(`(?i)(?:bot|crawler|spider|slurp)[/ ]?v?(\d+(?:\.\d+)*)?`)},
+	{"Edge", regexp.MustCompile(`(?:Edg|Edge|EdgA|EdgiOS)/(\d+(?:\.\d+)*)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/(\d+(?:\.\d+)*)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/(\d+(?:\.\d+)*)`)},
+	{"Yandex", regexp.MustCompile(`YaBrowser/(\d+(?:\.\d+)*)`)},
+	{"UC Browser", regexp.MustCompile(`UCBrowser/(\d+(?:\.\d+)*)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+(?:\.\d+)*)`)},
+	{"Chromium", regexp.MustCompile(`Chromium/(\d+(?:\.\d+)*)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+(?:\.\d+)*)`)},
+	{"Safari", regexp.MustCompile(`Version/(\d+(?:\.\d+)*).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)(\d+(?:\.\d+)*)`)},
+}
+
+var osRules = []uaRule{
+	{"Windows", regexp.MustCompile(`Windows NT (\d+(?:\.\d+)*)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|CPU) OS (\d+(?:_\d+)*)`)},
+	{"Android", regexp.MustCompile(`Android (\d+(?:\.\d+)*)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ (\d+(?:\.\d+)*)`)},
+	{"Mac OS X", regexp.MustCompile(`Mac OS X (\d+(?:[_.]\d+)*)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+var vendorRules = []uaRule{
+	{"Apple", regexp.MustCompile(`iPhone|iPad|iPod|Macintosh`)},
+	{"Samsung", regexp.MustCompile(`(?i)SAMSUNG|\bSM-[A-Z]`)},
+	{"Google", regexp.MustCompile(`Pixel`)},
+	{"Huawei", regexp.MustCompile(`(?i)HUAWEI|\bHONOR`)},
+	{"Xiaomi", regexp.MustCompile(`(?i)Xiaomi|Redmi|\bMi [0-9A-Z]`)},
+	{"OnePlus", regexp.MustCompile(`(?i)OnePlus`)},
+	{"Motorola", regexp.MustCompile(`(?i)\bmoto`)},
+}
+
+func ParseUserAgent(ua string) UserAgent {
+	parsed := UserAgent{DeviceType: DEVICE_OTHER}
+	if ua == "" {
+		return parsed
+	}
+
+	parsed.BrowserFamily, parsed.BrowserVersion = matchRules(browserRules, ua)
+	parsed.OSFamily, parsed.OSVersion = matchRules(osRules, ua)
+	parsed.OSVersion = strings.ReplaceAll(parsed.OSVersion, "_", ".")
+	if parsed.OSFamily == "Windows" {
+		if name, ok := windowsVersions[parsed.OSVersion]; ok {
+			parsed.OSVersion = name
+		}
+	}
+	parsed.DeviceVendor, _ = matchRules(vendorRules, ua)
+
+	switch {
+	case parsed.BrowserFamily == "Bot":
+		parsed.DeviceType = DEVICE_BOT
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+		(parsed.OSFamily == "Android" && !strings.Contains(ua, "Mobile")):
+		parsed.DeviceType = DEVICE_TABLET
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone"):
+		parsed.DeviceType = DEVICE_MOBILE
+	case parsed.OSFamily == "Windows" || parsed.OSFamily == "Mac OS X" ||
+		parsed.OSFamily == "Linux" || parsed.OSFamily == "Chrome OS":
+		parsed.DeviceType = DEVICE_DESKTOP
+	}
+	return parsed
+}
+
+// Leading number of the browser version, 0 when unknown.
+func (x UserAgent) BrowserMajor() int {
+	return MajorVersion(x.BrowserVersion)
+}
+
+func MajorVersion(version string) int {
+	major, _ := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return major
+}
+
+func matchRules(rules []uaRule, ua string) (string, string) {
+	for _, rule := range rules {
+		m := rule.regex.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		if len(m) > 1 {
+			return rule.family, m[1]
+		}
+		return rule.family, ""
+	}
+	return "", ""
+}
+
+// User-Agent Client Hints, the Sec-CH-UA-* request headers as sent by the browser.
+type ClientHints struct {
+	Brands          string `json:"ch_ua,omitempty"`
+	FullVersionList string `json:"ch_ua_full_version_list,omitempty"`
+	Mobile          string `json:"ch_ua_mobile,omitempty"`
+	Platform        string `json:"ch_ua_platform,omitempty"`
+	PlatformVersion string `json:"ch_ua_platform_version,omitempty"`
+	Model           string `json:"ch_ua_model,omitempty"`
+	Arch            string `json:"ch_ua_arch,omitempty"`
+	Bitness         string `json:"ch_ua_bitness,omitempty"`
+}
+
+// Hints asked for with Accept-CH, the first three are sent by default.
+var ClientHintHeaders = []string{
+	"Sec-CH-UA",
+	"Sec-CH-UA-Mobile",
+	"Sec-CH-UA-Platform",
+	"Sec-CH-UA-Full-Version-List",
+	"Sec-CH-UA-Platform-Version",
+	"Sec-CH-UA-Model",
+	"Sec-CH-UA-Arch",
+	"Sec-CH-UA-Bitness",
+}
+
+var brandRegex = regexp.MustCompile(`"([^"]*)"\s*;\s*v="([^"]*)"`)
+
+var brandFamilies = map[string]string{
+	"Google Chrome":    "Chrome",
+	"Microsoft Edge":   "Edge",
+	"Opera":            "Opera",
+	"Samsung Internet": "Samsung Internet",
+	"Yandex":           "Yandex",
+	"Chromium":         "Chromium",
+}
+
+var platformFamilies = map[string]string{
+	"Windows":   "Windows",
+	"macOS":     "Mac OS X",
+	"Android":   "Android",
+	"iOS":       "iOS",
+	"Chrome OS": "Chrome OS",
+	"Linux":     "Linux",
+}
+
+func ReadClientHints(header http.Header) ClientHints {
+	unquote := func(name string) string {
+		return strings.Trim(header.Get(name), `"`)
+	}
+	return ClientHints{
+		Brands:          header.Get("Sec-CH-UA"),
+		FullVersionList: header.Get("Sec-CH-UA-Full-Version-List"),
+		Mobile:          header.Get("Sec-CH-UA-Mobile"),
+		Platform:        unquote("Sec-CH-UA-Platform"),
+		PlatformVersion: unquote("Sec-CH-UA-Platform-Version"),
+		Model:           unquote("Sec-CH-UA-Model"),
+		Arch:            unquote("Sec-CH-UA-Arch"),
+		Bitness:         unquote("Sec-CH-UA-Bitness")}
+}
+
+func (x ClientHints) IsEmpty() bool {
+	return x == ClientHints{}
+}
+
+// Parse the legacy user-agent, then let the client hints fill in what the reduced UA string hides.
+func ParseUserAgentWithHints(ua string, hints ClientHints) UserAgent {
+	parsed := ParseUserAgent(ua)
+	if hints.IsEmpty() || parsed.DeviceType == DEVICE_BOT {
+		return parsed
+	}
+
+	brands := hints.FullVersionList
+	if brands == "" {
+		brands = hints.Brands
+	}
+	if family, version := parseBrands(brands); family != "" {
+		parsed.BrowserFamily = family
+		parsed.BrowserVersion = version
+	}
+
+	if family, ok := platformFamilies[hints.Platform]; ok {
+		parsed.OSFamily = family
+		if hints.PlatformVersion != "" {
+			parsed.OSVersion = platformVersion(family, hints.PlatformVersion)
+		}
+	}
+
+	if hints.Model != "" {
+		if vendor, _ := matchRules(vendorRules, hints.Model); vendor != "" {
+			parsed.DeviceVendor = vendor
+		}
+	}
+	if hints.Mobile == "?1" {
+		parsed.DeviceType = DEVICE_MOBILE
+	}
+	return parsed
+}
+
+// The most specific brand, skipping GREASE entries and preferring a vendor brand over Chromium.
+func parseBrands(brands string) (string, string) {
+	family, version := "", ""
+	for _, m := range brandRegex.FindAllStringSubmatch(brands, -1) {
+		name, ok := brandFamilies[m[1]]
+		if !ok {
+			continue
+		}
+		if family == "" || family == "Chromium" {
+			family, version = name, m[2]
+		}
+	}
+	return family, version
+}
+
+// Windows reports 1-10 for Windows 10 and 13+ for Windows 11 through the platform version hint.
+func platformVersion(family string, version string) string {
+	if family != "Windows" {
+		return version
+	}
+	major := MajorVersion(version)
+	if major >= 13 {
+		return "11"
+	}
+	if major > 0 {
+		return "10"
+	}
+	return version
+}